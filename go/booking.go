@@ -0,0 +1,123 @@
+package main
+
+// NewBookingSagaDefinition describes the booking saga: a booking is created,
+// paid for, and then confirmed. The confirmation is the pivot: the booking and
+// the payment are undone if it is rejected, and kept once it is confirmed.
+//
+// The booking is the input of the saga, and the commands are built from it.
+func NewBookingSagaDefinition() *SagaDefinition {
+	return NewSagaDefinition("booking-saga").
+		AddStep(NewStepDefinition("create-booking").
+			Invoke(CreateBookingCommand{}).
+			WithCompensation(CancelBookingCommand{}).
+			MapCompensation(Map(func(saga TypedSaga[BookingCreated]) (CancelBookingCommand, error) {
+				return CancelBookingCommand{BookingID: saga.Input.ID}, nil
+			})).
+			OnSuccess(BookingCreated{}).
+			OnCompensated(BookingCancelled{})).
+		AddStep(NewStepDefinition("create-payment").
+			Invoke(CreatePaymentCommand{}).
+			MapCommand(Map(func(saga TypedSaga[BookingCreated]) (CreatePaymentCommand, error) {
+				return CreatePaymentCommand{BookingID: saga.Input.ID, Amount: saga.Input.Amount}, nil
+			})).
+			WithCompensation(RefundPaymentCommand{}).
+			MapCompensation(Map(func(saga TypedSaga[BookingCreated]) (RefundPaymentCommand, error) {
+				return RefundPaymentCommand{BookingID: saga.Input.ID, Amount: saga.Input.Amount}, nil
+			})).
+			OnSuccess(PaymentCreated{}).
+			OnFailure(PaymentFailed{}).
+			OnCompensated(PaymentRefunded{})).
+		AddStep(NewStepDefinition("confirm-booking").
+			Invoke(ConfirmBookingCommand{}).
+			MapCommand(Map(func(saga TypedSaga[BookingCreated]) (ConfirmBookingCommand, error) {
+				booking, err := Response[BookingCreated](saga, "create-booking")
+				if err != nil {
+					return ConfirmBookingCommand{}, err
+				}
+				return ConfirmBookingCommand{BookingID: booking.ID}, nil
+			})).
+			AsPivot().
+			OnSuccess(BookingConfirmed{}).
+			OnFailure(BookingRejected{}))
+}
+
+type CreateBookingCommand struct {
+}
+
+func (c CreateBookingCommand) isCommand() {}
+
+type CreatePaymentCommand struct {
+	BookingID string
+	Amount    int
+}
+
+func (c CreatePaymentCommand) isCommand() {}
+
+type ConfirmBookingCommand struct {
+	BookingID string
+}
+
+func (c ConfirmBookingCommand) isCommand() {}
+
+type RefundPaymentCommand struct {
+	BookingID string
+	Amount    int
+}
+
+func (c RefundPaymentCommand) isCommand() {}
+
+type CancelBookingCommand struct {
+	BookingID string
+}
+
+func (c CancelBookingCommand) isCommand() {}
+
+type BookingCreated struct {
+	ID     string
+	Amount int
+}
+
+func (e BookingCreated) isEvent()       {}
+func (e BookingCreated) sagaID() string { return e.ID }
+
+type BookingCancelled struct {
+	ID string
+}
+
+func (e BookingCancelled) isEvent()       {}
+func (e BookingCancelled) sagaID() string { return e.ID }
+
+type PaymentCreated struct {
+	ID string
+}
+
+func (e PaymentCreated) isEvent()       {}
+func (e PaymentCreated) sagaID() string { return e.ID }
+
+type PaymentFailed struct {
+	ID string
+}
+
+func (e PaymentFailed) isEvent()       {}
+func (e PaymentFailed) sagaID() string { return e.ID }
+
+type PaymentRefunded struct {
+	ID string
+}
+
+func (e PaymentRefunded) isEvent()       {}
+func (e PaymentRefunded) sagaID() string { return e.ID }
+
+type BookingConfirmed struct {
+	ID string
+}
+
+func (e BookingConfirmed) isEvent()       {}
+func (e BookingConfirmed) sagaID() string { return e.ID }
+
+type BookingRejected struct {
+	ID string
+}
+
+func (e BookingRejected) isEvent()       {}
+func (e BookingRejected) sagaID() string { return e.ID }
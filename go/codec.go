@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec encodes and decodes the payloads of sagas, commands and events. The
+// name of the codec is stored with every payload, so that a payload is
+// decoded with the codec that encoded it, even after the saga definition has
+// moved to another codec.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSONCodec{}.Name():        JSONCodec{},
+		ProtobufCodec{}.Name():    ProtobufCodec{},
+		MessagePackCodec{}.Name(): MessagePackCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available to decode the payloads encoded
+// with it. It replaces the codec registered with the same name.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+// lookupCodec returns the codec registered with the name. Payloads stored
+// before their codec was recorded have no codec name, and are JSON.
+func lookupCodec(name string) (Codec, error) {
+	if name == "" {
+		return JSONCodec{}, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec %q is not registered", name)
+	}
+	return codec, nil
+}
+
+// unmarshal decodes the payload into v with the codec registered with the
+// name.
+func unmarshal(name string, data []byte, v interface{}) error {
+	codec, err := lookupCodec(name)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// JSONCodec encodes payloads as JSON. It is the codec of saga definitions
+// that do not set one.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MessagePackCodec encodes payloads as MessagePack.
+type MessagePackCodec struct{}
+
+func (MessagePackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec encodes payloads as Protocol Buffers. Generated messages
+// cannot implement the unexported methods of commands and events, so the
+// commands and events of the saga embed a pointer to their generated message:
+//
+//	type BookingCreated struct{ *bookingpb.BookingCreated }
+//
+//	func (e BookingCreated) isEvent()       {}
+//	func (e BookingCreated) sagaID() string { return e.GetId() }
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := protoMessage(v)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec cannot encode %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := protoMessage(v)
+	if !ok {
+		return fmt.Errorf("protobuf codec cannot decode into %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// protoMessage returns the generated message embedded in v, allocating it when
+// v is a pointer to be decoded into, or v itself if it is a generated message.
+func protoMessage(v interface{}) (proto.Message, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			if !field.Anonymous || field.Type.Kind() != reflect.Ptr || !field.Type.Implements(protoMessageType) {
+				continue
+			}
+			f := rv.Field(i)
+			if f.IsNil() && f.CanSet() {
+				f.Set(reflect.New(field.Type.Elem()))
+			}
+			return f.Interface().(proto.Message), true
+		}
+	}
+	m, ok := v.(proto.Message)
+	return m, ok
+}
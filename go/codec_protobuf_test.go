@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"saga/testdata/bookingpb"
+)
+
+type protoBookingCreated struct{ *bookingpb.BookingCreated }
+
+func (e protoBookingCreated) isEvent()       {}
+func (e protoBookingCreated) sagaID() string { return e.GetId() }
+
+type protoCreatePayment struct{ *bookingpb.CreatePayment }
+
+func (c protoCreatePayment) isCommand() {}
+
+type protoPaymentCreated struct{ *bookingpb.PaymentCreated }
+
+func (e protoPaymentCreated) isEvent()       {}
+func (e protoPaymentCreated) sagaID() string { return e.GetId() }
+
+func newProtoBookingSagaDefinition() *SagaDefinition {
+	return NewSagaDefinition("proto-booking-saga").
+		WithCodec(ProtobufCodec{}).
+		AddStep(NewStepDefinition("create-booking").
+			OnSuccess(protoBookingCreated{})).
+		AddStep(NewStepDefinition("create-payment").
+			Invoke(protoCreatePayment{}).
+			MapCommand(Map(func(saga TypedSaga[protoBookingCreated]) (protoCreatePayment, error) {
+				return protoCreatePayment{&bookingpb.CreatePayment{
+					BookingId: saga.Input.GetId(),
+					Amount:    saga.Input.GetAmount(),
+					Currency:  saga.Input.GetCurrency(),
+				}}, nil
+			})).
+			OnSuccess(protoPaymentCreated{}))
+}
+
+// addCurrency upgrades the payloads of the first version of the schema, which
+// had no currency.
+func addCurrency(typ string, codec Codec, payload []byte) ([]byte, error) {
+	switch typ {
+	case typeName(protoBookingCreated{}):
+		var evt protoBookingCreated
+		if err := codec.Unmarshal(payload, &evt); err != nil {
+			return nil, err
+		}
+		evt.Currency = "EUR"
+		return codec.Marshal(evt)
+	case typeName(protoCreatePayment{}):
+		var cmd protoCreatePayment
+		if err := codec.Unmarshal(payload, &cmd); err != nil {
+			return nil, err
+		}
+		cmd.Currency = "EUR"
+		return codec.Marshal(cmd)
+	}
+	return payload, nil
+}
+
+func TestProtobufCodec(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the saga is encoded as Protocol Buffers", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newProtoBookingSagaDefinition())
+
+			handle(t, sec, protoBookingCreated{&bookingpb.BookingCreated{Id: "1", Amount: 250, Currency: "EUR"}})
+
+			// Then the command is a generated message.
+			commands := pub.Commands()
+			require.Len(t, commands, 1)
+			assert.Equal("protobuf", commands[0].Codec)
+			var payment bookingpb.CreatePayment
+			assert.Nil(proto.Unmarshal(commands[0].Payload, &payment))
+			assert.True(proto.Equal(&bookingpb.CreatePayment{BookingId: "1", Amount: 250, Currency: "EUR"}, &payment))
+
+			// When the participant replies.
+			handler := StepHandler[protoCreatePayment, protoPaymentCreated](func(ctx context.Context, cmd protoCreatePayment) (protoPaymentCreated, error) {
+				return protoPaymentCreated{&bookingpb.PaymentCreated{Id: cmd.GetBookingId()}}, nil
+			})
+			res, err := handler.Handle(ctx, commands[0])
+			require.Nil(t, err)
+			saga, err := sec.HandleEvent(ctx, res)
+			require.Nil(t, err)
+			require.Nil(t, sec.Continue(ctx, *saga))
+
+			// Then the saga completes, and its payloads are decoded
+			// into the events.
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, found.Status)
+			var booking protoBookingCreated
+			assert.Nil(found.DecodePayload(&booking))
+			assert.Equal("EUR", booking.GetCurrency())
+			var created protoPaymentCreated
+			assert.Nil(found.DecodeResponse("create-payment", &created))
+			assert.Equal("1", created.GetId())
+		})
+
+		t.Run("when the payloads were stored in an earlier version of the schema", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), newProtoBookingSagaDefinition())
+			handle(t, sec, protoBookingCreated{&bookingpb.BookingCreated{Id: "1", Amount: 250}})
+			saga, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			step, err := saga.GetStep("create-payment")
+			require.Nil(t, err)
+
+			def := newProtoBookingSagaDefinition().WithSchemaVersion(2).WithPayloadUpgrade(2, addCurrency)
+			sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), def)
+			env, err := NewEventEnvelopeWith(ProtobufCodec{}, step.RequestMetadata.SchemaVersion, protoPaymentCreated{&bookingpb.PaymentCreated{Id: "1"}})
+			require.Nil(t, err)
+			assert.Equal(1, env.SchemaVersion)
+			_, err = sec.HandleMessage(ctx, env)
+			require.Nil(t, err)
+
+			// Then the payloads are upgraded to the new version.
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(2, saga.PayloadSchemaVersion)
+			var booking protoBookingCreated
+			assert.Nil(saga.DecodePayload(&booking))
+			assert.True(proto.Equal(&bookingpb.BookingCreated{Id: "1", Amount: 250, Currency: "EUR"}, booking.BookingCreated))
+			step, err = saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal(2, step.RequestMetadata.SchemaVersion)
+			assert.Equal(2, step.ResponseMetadata.SchemaVersion)
+			var payment protoCreatePayment
+			assert.Nil(ProtobufCodec{}.Unmarshal(step.RequestPayload, &payment))
+			assert.Equal("EUR", payment.GetCurrency())
+		})
+	})
+
+	t.Run("when an upgrade targets a version the saga does not have", func(t *testing.T) {
+		def := newProtoBookingSagaDefinition().WithPayloadUpgrade(2, addCurrency)
+		assert.NotNil(t, def.Validate())
+	})
+}
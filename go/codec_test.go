@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reversedCodec encodes payloads as reversed JSON, so that they cannot be
+// decoded as JSON.
+type reversedCodec struct{}
+
+func (reversedCodec) Name() string {
+	return "reversed"
+}
+
+func (reversedCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := JSONCodec{}.Marshal(v)
+	return reverse(b), err
+}
+
+func (reversedCodec) Unmarshal(data []byte, v interface{}) error {
+	return JSONCodec{}.Unmarshal(reverse(data), v)
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+func TestCodec(t *testing.T) {
+	ctx := context.Background()
+	RegisterCodec(reversedCodec{})
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the saga has a codec", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			def := NewBookingSagaDefinition().WithCodec(reversedCodec{}).WithSchemaVersion(3)
+			sec := NewExecutionCoordinator(store, pub, def)
+
+			handle(t, sec, BookingCreated{ID: "1", Amount: 250})
+
+			// Then the payloads are encoded with the codec, and stored
+			// with its name and the schema version.
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal("reversed", saga.PayloadCodec)
+			assert.Equal(3, saga.PayloadSchemaVersion)
+			step, err := saga.GetStep("create-booking")
+			assert.Nil(err)
+			assert.Equal("reversed", step.ResponseMetadata.Codec)
+			assert.Equal(3, step.ResponseMetadata.SchemaVersion)
+			step, err = saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal("reversed", step.RequestMetadata.Codec)
+
+			cmd := pub.Commands()[0]
+			assert.Equal("reversed", cmd.Codec)
+			var payment CreatePaymentCommand
+			assert.NotNil(JSONCodec{}.Unmarshal(cmd.Payload, &payment))
+			assert.Nil(reversedCodec{}.Unmarshal(cmd.Payload, &payment))
+			assert.Equal(250, payment.Amount)
+		})
+
+		t.Run("when the codec changes while the saga is in flight", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			handle(t, sec, BookingCreated{ID: "1", Amount: 250})
+
+			def := NewBookingSagaDefinition().WithCodec(reversedCodec{}).WithSchemaVersion(2)
+			sec = NewExecutionCoordinator(store, pub, def)
+			handle(t, sec, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			// Then the payloads stored before are still decoded with
+			// their codec.
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal("json", saga.PayloadCodec)
+			assert.Equal(SchemaVersion, saga.PayloadSchemaVersion)
+			step, err := saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal("reversed", step.ResponseMetadata.Codec)
+
+			commands := pub.Commands()
+			require.Len(t, commands, 3)
+			assert.Equal("json", commands[0].Codec)
+			var refund RefundPaymentCommand
+			assert.Nil(unmarshal(commands[2].Codec, commands[2].Payload, &refund))
+			assert.Equal(RefundPaymentCommand{BookingID: "1", Amount: 250}, refund)
+		})
+	})
+
+	t.Run("when the codec is not registered", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := lookupCodec("xml")
+		assert.NotNil(err)
+		codec, err := lookupCodec("")
+		assert.Nil(err)
+		assert.Equal(JSONCodec{}, codec)
+
+		def := NewBookingSagaDefinition().WithCodec(unregisteredCodec{})
+		assert.NotNil(def.Validate())
+	})
+
+	t.Run("when payloads are encoded as MessagePack", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b, err := MessagePackCodec{}.Marshal(CreatePaymentCommand{BookingID: "1", Amount: 250})
+		assert.Nil(err)
+		var cmd CreatePaymentCommand
+		assert.Nil(MessagePackCodec{}.Unmarshal(b, &cmd))
+		assert.Equal(CreatePaymentCommand{BookingID: "1", Amount: 250}, cmd)
+	})
+
+	t.Run("when a payload is not a protobuf message", func(t *testing.T) {
+		_, err := ProtobufCodec{}.Marshal(CreatePaymentCommand{})
+		assert.NotNil(t, err)
+		assert.NotNil(t, ProtobufCodec{}.Unmarshal(nil, &CreatePaymentCommand{}))
+	})
+}
+
+type unregisteredCodec struct {
+	JSONCodec
+}
+
+func (unregisteredCodec) Name() string {
+	return "unregistered"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelCompensation(t *testing.T) {
+	ctx := context.Background()
+	newDefinition := func() *SagaDefinition {
+		return NewBookingSagaDefinition().WithCompensationMode(CompensateInParallel)
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the booking is rejected", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newDefinition())
+
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			// Then all the compensations are sent at once.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+				"RefundPaymentCommand create-payment",
+				"CancelBookingCommand create-booking",
+			}, steps(pub))
+
+			// And the compensation events arrive in any order, without
+			// the compensations being sent again.
+			handle(t, sec, BookingCancelled{ID: "1"})
+			assert.Len(pub.Commands(), 4)
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensating, saga.Status)
+
+			handle(t, sec, PaymentRefunded{ID: "1"})
+			assert.Len(pub.Commands(), 4)
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+		})
+	})
+
+	t.Run("when a compensation cannot be sent", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := &failingPublisher{
+			InMemoryPublisher: NewInMemoryPublisher(),
+			typ:               "RefundPaymentCommand",
+			failures:          1,
+			err:               errors.New("payment service unavailable"),
+		}
+		sec := NewExecutionCoordinator(store, pub, newDefinition())
+
+		handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"})
+		saga, err := sec.HandleEvent(ctx, BookingRejected{ID: "1"})
+		require.Nil(t, err)
+
+		// Then the other compensations are still sent.
+		assert.EqualError(sec.Continue(ctx, *saga), "payment service unavailable")
+		assert.Equal("CancelBookingCommand create-booking", steps(pub.InMemoryPublisher)[2])
+
+		// And only the failed compensation is sent again.
+		retrier := sec.Retrier()
+		retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+		n, err := retrier.Retry(ctx)
+		assert.Nil(err)
+		assert.Equal(1, n)
+		assert.Equal([]string{
+			"CreatePaymentCommand create-payment",
+			"ConfirmBookingCommand confirm-booking",
+			"CancelBookingCommand create-booking",
+			"RefundPaymentCommand create-payment",
+		}, steps(pub.InMemoryPublisher))
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The order saga charges the price of an order, once high value orders have
+// been approved.
+type (
+	OrderPlaced struct {
+		ID    string
+		Price int
+	}
+	OrderCancelled struct{ ID string }
+	OrderApproved  struct{ ID string }
+	OrderDeclined  struct{ ID string }
+	OrderCharged   struct{ ID string }
+	ChargeFailed   struct{ ID string }
+
+	CancelOrderCommand  struct{}
+	ApproveOrderCommand struct{}
+	ChargeOrderCommand  struct{}
+)
+
+func (OrderPlaced) isEvent()    {}
+func (OrderCancelled) isEvent() {}
+func (OrderApproved) isEvent()  {}
+func (OrderDeclined) isEvent()  {}
+func (OrderCharged) isEvent()   {}
+func (ChargeFailed) isEvent()   {}
+
+func (e OrderPlaced) sagaID() string    { return e.ID }
+func (e OrderCancelled) sagaID() string { return e.ID }
+func (e OrderApproved) sagaID() string  { return e.ID }
+func (e OrderDeclined) sagaID() string  { return e.ID }
+func (e OrderCharged) sagaID() string   { return e.ID }
+func (e ChargeFailed) sagaID() string   { return e.ID }
+
+func (CancelOrderCommand) isCommand()  {}
+func (ApproveOrderCommand) isCommand() {}
+func (ChargeOrderCommand) isCommand()  {}
+
+// priceAbove holds when the price of the placed order is above the limit.
+func priceAbove(limit int) Condition {
+	return func(saga Saga) (bool, error) {
+		step, err := saga.GetStep("place-order")
+		if err != nil {
+			return false, err
+		}
+		var evt OrderPlaced
+		if err := json.Unmarshal(step.ResponsePayload, &evt); err != nil {
+			return false, err
+		}
+		return evt.Price > limit, nil
+	}
+}
+
+func newOrderSagaDefinition() *SagaDefinition {
+	return NewSagaDefinition("order-saga").
+		AddStep(NewStepDefinition("place-order").
+			WithCompensation(CancelOrderCommand{}).
+			OnSuccess(OrderPlaced{}).
+			OnCompensated(OrderCancelled{})).
+		AddStep(NewStepDefinition("approve-order").
+			Invoke(ApproveOrderCommand{}).
+			When(priceAbove(1000)).
+			OnSuccess(OrderApproved{}).
+			OnFailure(OrderDeclined{})).
+		AddStep(NewStepDefinition("charge-order").
+			Invoke(ChargeOrderCommand{}).
+			When(priceAbove(0)).
+			OnSuccess(OrderCharged{}).
+			OnFailure(ChargeFailed{}))
+}
+
+func TestCondition(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the order is free", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newOrderSagaDefinition())
+
+			handle(t, sec, OrderPlaced{ID: "1"})
+
+			// Then the steps are skipped, and the saga completes.
+			assert.Empty(pub.Commands())
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+			for _, name := range []string{"approve-order", "charge-order"} {
+				step, err := saga.GetStep(name)
+				assert.Nil(err)
+				assert.Equal(StepStatusSkipped, step.Status)
+			}
+		})
+
+		t.Run("when the order is of high value", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newOrderSagaDefinition())
+
+			// Then the order is approved before it is charged.
+			handle(t, sec, OrderPlaced{ID: "1", Price: 5000}, OrderApproved{ID: "1"}, OrderCharged{ID: "1"})
+			assert.Equal([]string{
+				"ApproveOrderCommand approve-order",
+				"ChargeOrderCommand charge-order",
+			}, steps(pub))
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+		})
+
+		t.Run("when the charge fails", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newOrderSagaDefinition())
+
+			handle(t, sec, OrderPlaced{ID: "1", Price: 10}, ChargeFailed{ID: "1"})
+
+			// Then the skipped approval has nothing to undo.
+			assert.Equal([]string{
+				"ChargeOrderCommand charge-order",
+				"CancelOrderCommand place-order",
+			}, steps(pub))
+
+			handle(t, sec, OrderCancelled{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+			step, err := saga.GetStep("approve-order")
+			assert.Nil(err)
+			assert.Equal(StepStatusSkipped, step.Status)
+		})
+	})
+
+	t.Run("when the condition fails", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		def := newOrderSagaDefinition()
+		stepDef, err := def.GetStep("approve-order")
+		require.Nil(t, err)
+		stepDef.When(func(saga Saga) (bool, error) {
+			return false, errors.New("approval limit unavailable")
+		})
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), def)
+
+		saga, err := sec.HandleEvent(ctx, OrderPlaced{ID: "1"})
+		require.Nil(t, err)
+
+		// Then the step is left pending until the saga is continued again.
+		assert.ErrorContains(sec.Continue(ctx, *saga), "approval limit unavailable")
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err := found.GetStep("approve-order")
+		assert.Nil(err)
+		assert.Equal(StepStatusPending, step.Status)
+	})
+
+	t.Run("when the first step has a condition", func(t *testing.T) {
+		def := newOrderSagaDefinition()
+		def.Steps[0].When(priceAbove(0))
+
+		assert.NotNil(t, def.Validate())
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CompensationResolved reports that a step that could not be compensated has
+// been undone manually.
+type CompensationResolved struct {
+	SagaID string
+	Step   string
+}
+
+func (CompensationResolved) isEvent() {}
+
+func (e CompensationResolved) sagaID() string {
+	return e.SagaID
+}
+
+// DeadLetter is a compensation that keeps failing, in a saga that is stuck.
+type DeadLetter struct {
+	SagaID    string
+	SagaName  string
+	Step      string
+	Attempts  int
+	LastError string
+	NextRetry *time.Time
+}
+
+func newDeadLetter(saga Saga, step Step) DeadLetter {
+	step = step.clone()
+	return DeadLetter{
+		SagaID:    saga.ID,
+		SagaName:  saga.Name,
+		Step:      step.Name,
+		Attempts:  step.Attempts,
+		LastError: step.LastError,
+		NextRetry: step.NextRetry,
+	}
+}
+
+// DeadLetters is implemented by repositories that can find the compensations
+// of stuck sagas.
+type DeadLetters interface {
+	// DeadLetters returns up to limit failing compensations of stuck sagas,
+	// ordered by saga.
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+}
+
+// ResolveDeadLetter marks the step as compensated once it has been undone
+// manually, and continues the compensation of the saga. The compensation
+// command of the step is no longer retried.
+func (ec *ExecutionCoordinator) ResolveDeadLetter(ctx context.Context, sagaID, step string) (*Saga, error) {
+	saga, err := ec.HandleEvent(ctx, CompensationResolved{
+		SagaID: sagaID,
+		Step:   step,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ec.Continue(ctx, *saga); err != nil {
+		return nil, err
+	}
+	found, err := ec.findSaga(ctx, sagaID)
+	if err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// handleResolved moves the step from success to compensated. Steps that have
+// been compensated in the meantime are left unchanged.
+func (ec *ExecutionCoordinator) handleResolved(ctx context.Context, saga *Saga, env Envelope, evt CompensationResolved) (*Saga, error) {
+	step, err := saga.GetStep(evt.Step)
+	if err != nil {
+		return nil, err
+	}
+	if step.Status == StepStatusCompensated {
+		return saga, nil
+	}
+	if step.Status != StepStatusSuccess || saga.CheckStatus() != SagaStatusCompensating {
+		return nil, fmt.Errorf("step %q of saga %q is not being compensated", step.Name, saga.ID)
+	}
+	if err := applyEvent(saga, step, StepStatusCompensated, env, evt); err != nil {
+		return nil, err
+	}
+	updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+	return &updatedSaga, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	policy := RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     2 * time.Minute,
+		Multiplier:     2,
+	}
+
+	// compensate fails the payment, so that the booking is cancelled with a
+	// command that fails the given number of times.
+	compensate := func(t *testing.T, store testStore, failures int) (*ExecutionCoordinator, *failingPublisher) {
+		pub := &failingPublisher{
+			InMemoryPublisher: NewInMemoryPublisher(),
+			typ:               "CancelBookingCommand",
+			failures:          failures,
+			err:               errors.New("booking service unavailable"),
+		}
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).WithCompensationRetry(policy)
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+		saga, err = sec.HandleEvent(ctx, PaymentFailed{ID: "1"})
+		require.Nil(t, err)
+		assert.NotNil(t, sec.CompensationFlow(ctx, *saga))
+		return sec, pub
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the compensation keeps failing", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec, _ := compensate(t, store, -1)
+
+			letters, err := store.DeadLetters(ctx, 10)
+			assert.Nil(err)
+			assert.Empty(letters)
+
+			retrier := sec.Retrier()
+			retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+			for i := 0; i < 3; i++ {
+				_, err := retrier.Retry(ctx)
+				assert.Nil(err)
+			}
+
+			// Then the saga is stuck, and the compensation is still
+			// retried with a capped backoff.
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusStuck, found.Status)
+
+			letters, err = store.DeadLetters(ctx, 10)
+			assert.Nil(err)
+			require.Len(t, letters, 1)
+			assert.Equal("1", letters[0].SagaID)
+			assert.Equal("booking-saga", letters[0].SagaName)
+			assert.Equal("create-booking", letters[0].Step)
+			assert.Equal(4, letters[0].Attempts)
+			assert.Equal("booking service unavailable", letters[0].LastError)
+			require.NotNil(t, letters[0].NextRetry)
+			assert.WithinDuration(time.Now(), *letters[0].NextRetry, 2*time.Minute+time.Second)
+
+			// When the booking is cancelled manually.
+			saga, err := sec.ResolveDeadLetter(ctx, "1", "create-booking")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+
+			letters, err = store.DeadLetters(ctx, 10)
+			assert.Nil(err)
+			assert.Empty(letters)
+
+			n, err := retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+		})
+
+		t.Run("when the compensation eventually succeeds", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec, pub := compensate(t, store, 2)
+
+			retrier := sec.Retrier()
+			retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+			_, err := retrier.Retry(ctx)
+			assert.Nil(err)
+
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusStuck, found.Status)
+
+			_, err = retrier.Retry(ctx)
+			assert.Nil(err)
+			commands := pub.Commands()
+			assert.Equal("CancelBookingCommand", commands[len(commands)-1].Type)
+
+			// Then the saga is no longer stuck once the booking is
+			// cancelled.
+			saga, err := sec.HandleEvent(ctx, BookingCancelled{ID: "1"})
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+
+			letters, err := store.DeadLetters(ctx, 10)
+			assert.Nil(err)
+			assert.Empty(letters)
+		})
+	})
+
+	t.Run("when the saga is not compensating", func(t *testing.T) {
+		sec := NewExecutionCoordinator(NewInMemoryStore(), NewInMemoryPublisher(), NewBookingSagaDefinition())
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+		_, err = sec.ResolveDeadLetter(ctx, "1", "create-booking")
+		assert.NotNil(t, err)
+	})
+}
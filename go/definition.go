@@ -0,0 +1,673 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Transition describes how an event moves a step from one status to another.
+type Transition struct {
+	Event event
+	From  StepStatus
+	To    StepStatus
+}
+
+// StepDefinition describes a single step of a saga: the command that executes
+// it, the command that undoes it, and the events that report the outcome.
+type StepDefinition struct {
+	Name         string
+	Command      command
+	Compensation command
+	Transitions  []Transition
+
+	// Timeout is how long the step waits for its event after the command is
+	// sent, before it fails. The step waits indefinitely when zero.
+	Timeout time.Duration
+
+	// Retry is the policy for sending the commands of the step again when
+	// they cannot be published. Commands are not retried when nil.
+	Retry *RetryPolicy
+
+	// Kind is whether the step can be undone, and how the saga recovers when
+	// it fails.
+	Kind StepKind
+
+	// Condition decides whether the step runs once the steps before it are
+	// done. The step always runs when nil.
+	Condition Condition
+
+	// CommandMapper and CompensationMapper build the commands of the step
+	// from the saga. The commands are sent as they are when nil.
+	CommandMapper      CommandMapper
+	CompensationMapper CommandMapper
+
+	// group is the group the step runs in parallel with, if any.
+	group *StepGroup
+}
+
+func NewStepDefinition(name string) *StepDefinition {
+	return &StepDefinition{
+		Name: name,
+	}
+}
+
+// Invoke sets the command that executes the step.
+func (s *StepDefinition) Invoke(cmd command) *StepDefinition {
+	s.Command = cmd
+	return s
+}
+
+// WithCompensation sets the command that undoes the step.
+func (s *StepDefinition) WithCompensation(cmd command) *StepDefinition {
+	s.Compensation = cmd
+	return s
+}
+
+// MapCommand builds the command of the step from the saga, when it is sent.
+// The mapper must return a command of the same type as the one invoked.
+func (s *StepDefinition) MapCommand(mapper CommandMapper) *StepDefinition {
+	s.CommandMapper = mapper
+	return s
+}
+
+// MapCompensation builds the compensation of the step from the saga, when it
+// is sent. The mapper must return a command of the same type as the
+// compensation.
+func (s *StepDefinition) MapCompensation(mapper CommandMapper) *StepDefinition {
+	s.CompensationMapper = mapper
+	return s
+}
+
+// command returns the prototype of the command that moves the step from the
+// given status.
+func (s *StepDefinition) command(from StepStatus) command {
+	if from == StepStatusSuccess {
+		return s.Compensation
+	}
+	return s.Command
+}
+
+// buildCommand returns the command that moves the step from the given
+// status: the command of the step from pending, and its compensation from
+// success.
+func (s *StepDefinition) buildCommand(saga Saga, from StepStatus) (command, error) {
+	cmd, mapper := s.command(from), s.CommandMapper
+	if from == StepStatusSuccess {
+		mapper = s.CompensationMapper
+	}
+	if mapper == nil {
+		return cmd, nil
+	}
+	mapped, err := mapper(saga)
+	if err != nil {
+		return nil, fmt.Errorf("map command of step %q: %w", s.Name, err)
+	}
+	if typeName(mapped) != typeName(cmd) {
+		return nil, fmt.Errorf("step %q mapped command %s instead of %s", s.Name, typeName(mapped), typeName(cmd))
+	}
+	return mapped, nil
+}
+
+// WithTimeout fails the step if no event is received within the timeout after
+// the command is sent.
+func (s *StepDefinition) WithTimeout(timeout time.Duration) *StepDefinition {
+	s.Timeout = timeout
+	return s
+}
+
+// When runs the step only if the condition holds, and skips it otherwise.
+func (s *StepDefinition) When(cond Condition) *StepDefinition {
+	s.Condition = cond
+	return s
+}
+
+// AsPivot marks the step as the pivot of the saga. The steps before it are
+// compensated if it fails, and the saga can no longer be undone once it
+// succeeds.
+func (s *StepDefinition) AsPivot() *StepDefinition {
+	s.Kind = StepPivot
+	return s
+}
+
+// AsRetriable marks a step after the pivot as retriable. The command of the
+// step is sent again until the step succeeds, instead of compensating the
+// saga.
+func (s *StepDefinition) AsRetriable() *StepDefinition {
+	s.Kind = StepRetriable
+	return s
+}
+
+// retryPolicy returns the retry policy of the step, or the default policy if
+// it has none.
+func (s *StepDefinition) retryPolicy() RetryPolicy {
+	if s.Retry == nil {
+		return DefaultRetryPolicy
+	}
+	return *s.Retry
+}
+
+// WithRetry sends the commands of the step again according to the policy,
+// when they cannot be published.
+func (s *StepDefinition) WithRetry(policy RetryPolicy) *StepDefinition {
+	s.Retry = &policy
+	return s
+}
+
+// On registers an event that moves the step from one status to another.
+func (s *StepDefinition) On(evt event, from, to StepStatus) *StepDefinition {
+	s.Transitions = append(s.Transitions, Transition{
+		Event: evt,
+		From:  from,
+		To:    to,
+	})
+	return s
+}
+
+// OnSuccess registers the event that completes the step.
+func (s *StepDefinition) OnSuccess(evt event) *StepDefinition {
+	return s.On(evt, StepStatusPending, StepStatusSuccess)
+}
+
+// OnFailure registers the event that fails the step.
+func (s *StepDefinition) OnFailure(evt event) *StepDefinition {
+	return s.On(evt, StepStatusPending, StepStatusFailed)
+}
+
+// OnCompensated registers the event that reports the step has been undone.
+func (s *StepDefinition) OnCompensated(evt event) *StepDefinition {
+	return s.On(evt, StepStatusSuccess, StepStatusCompensated)
+}
+
+// CommandMapper builds a command from the input of the saga and the responses
+// of the steps before it.
+type CommandMapper func(saga Saga) (command, error)
+
+// Condition decides whether a step runs, from the saga and the responses of
+// the steps before it. The step is skipped when it returns false.
+type Condition func(saga Saga) (bool, error)
+
+// StepKind is the role of a step in the recovery of a saga.
+type StepKind int
+
+const (
+	// StepCompensatable steps are undone by their compensation when a later
+	// step fails.
+	StepCompensatable StepKind = iota
+
+	// StepPivot is the step after which the saga can no longer be undone.
+	// The saga is compensated if the pivot fails, and runs to completion once
+	// it succeeds.
+	StepPivot
+
+	// StepRetriable steps follow the pivot, and are retried until they
+	// succeed. Their failures never compensate the saga.
+	StepRetriable
+)
+
+// StepGroup is a set of steps whose commands are sent at the same time. The
+// saga proceeds once Required of the steps have succeeded, and is compensated
+// once so many steps have failed that Required can no longer be reached.
+type StepGroup struct {
+	Name  string
+	Steps []*StepDefinition
+
+	// Required is the number of steps that must succeed. All the steps must
+	// succeed when zero.
+	Required int
+}
+
+func NewStepGroup(name string) *StepGroup {
+	return &StepGroup{
+		Name: name,
+	}
+}
+
+// AddStep adds a step to the group.
+func (g *StepGroup) AddStep(step *StepDefinition) *StepGroup {
+	g.Steps = append(g.Steps, step)
+	return g
+}
+
+// WithQuorum proceeds once n of the steps have succeeded.
+func (g *StepGroup) WithQuorum(n int) *StepGroup {
+	g.Required = n
+	return g
+}
+
+// stage is a single step, or a group of steps, that the saga waits for before
+// proceeding.
+type stage struct {
+	group *StepGroup
+	steps []*StepDefinition
+}
+
+// Migrator upgrades a saga from the previous version of its definition, e.g.
+// by inserting the steps added to the definition. The migrated saga must have
+// the steps of the new version.
+type Migrator func(saga *Saga) error
+
+// PayloadUpgrade upgrades a payload of the given message type from the
+// previous version of the schema of the saga, e.g. by filling in a field
+// added to an event. It returns the payload encoded with the same codec.
+type PayloadUpgrade func(typ string, codec Codec, payload []byte) ([]byte, error)
+
+// CompensationMode is how the successful steps of a saga are undone.
+type CompensationMode int
+
+const (
+	// CompensateInReverse undoes the steps one at a time, in reverse order.
+	// Each step waits for its compensation event before the previous step is
+	// undone.
+	CompensateInReverse CompensationMode = iota
+
+	// CompensateInParallel sends all the compensation commands at once, for
+	// steps that can be undone independently.
+	CompensateInParallel
+)
+
+// SagaDefinition describes the ordered steps of a saga. The first step is
+// triggered externally, and its success event starts the saga.
+type SagaDefinition struct {
+	Name         string
+	Version      uint
+	Steps        []*StepDefinition
+	Compensation CompensationMode
+
+	// Migrate upgrades a saga from the previous version of the definition to
+	// this one when it is loaded. Sagas of the previous version continue on
+	// it when nil.
+	Migrate Migrator
+
+	// Codec encodes the commands and events of the saga, in the version
+	// SchemaVersion of their schema. The payloads are JSON when nil.
+	Codec         Codec
+	SchemaVersion int
+
+	// Upgrades upgrade the payloads stored in an earlier version of the
+	// schema, keyed by the version they upgrade to. Payloads are left
+	// unchanged by the versions that have no upgrade.
+	Upgrades map[int]PayloadUpgrade
+}
+
+func NewSagaDefinition(name string) *SagaDefinition {
+	return &SagaDefinition{
+		Name:    name,
+		Version: 1,
+	}
+}
+
+// WithVersion sets the version of the definition. Sagas start on the latest
+// version registered with the coordinator.
+func (d *SagaDefinition) WithVersion(version uint) *SagaDefinition {
+	d.Version = version
+	return d
+}
+
+// WithMigration upgrades the sagas of the previous version to this one, when
+// they are loaded.
+func (d *SagaDefinition) WithMigration(migrate Migrator) *SagaDefinition {
+	d.Migrate = migrate
+	return d
+}
+
+// AddStep appends a step to the saga.
+func (d *SagaDefinition) AddStep(step *StepDefinition) *SagaDefinition {
+	d.Steps = append(d.Steps, step)
+	return d
+}
+
+// WithCompensationMode sets how the successful steps are undone.
+func (d *SagaDefinition) WithCompensationMode(mode CompensationMode) *SagaDefinition {
+	d.Compensation = mode
+	return d
+}
+
+// WithCodec encodes the commands and events of the saga with the codec. The
+// payloads of sagas in flight are still decoded with the codec they were
+// encoded with.
+func (d *SagaDefinition) WithCodec(codec Codec) *SagaDefinition {
+	d.Codec = codec
+	return d
+}
+
+// WithSchemaVersion sets the version stored with the payloads, to be bumped
+// when the commands or events of the saga change shape.
+func (d *SagaDefinition) WithSchemaVersion(version int) *SagaDefinition {
+	d.SchemaVersion = version
+	return d
+}
+
+// WithPayloadUpgrade upgrades the payloads stored in the previous version of
+// the schema to the given version, when they are loaded or received.
+func (d *SagaDefinition) WithPayloadUpgrade(version int, upgrade PayloadUpgrade) *SagaDefinition {
+	if d.Upgrades == nil {
+		d.Upgrades = make(map[int]PayloadUpgrade)
+	}
+	d.Upgrades[version] = upgrade
+	return d
+}
+
+// codec returns the codec of the saga, or JSON if it has none.
+func (d *SagaDefinition) codec() Codec {
+	if d.Codec == nil {
+		return JSONCodec{}
+	}
+	return d.Codec
+}
+
+// schemaVersion returns the schema version of the saga, or SchemaVersion if
+// it has none.
+func (d *SagaDefinition) schemaVersion() int {
+	if d.SchemaVersion == 0 {
+		return SchemaVersion
+	}
+	return d.SchemaVersion
+}
+
+// upgrade applies the upgrades of the later versions of the schema to the
+// payload described by the metadata, and moves the metadata to the version of
+// the last upgrade applied.
+func (d *SagaDefinition) upgrade(md *Metadata, payload []byte) ([]byte, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	for version := md.SchemaVersion + 1; version <= d.schemaVersion(); version++ {
+		upgrade, ok := d.Upgrades[version]
+		if !ok {
+			continue
+		}
+		codec, err := lookupCodec(md.Codec)
+		if err != nil {
+			return nil, err
+		}
+		payload, err = upgrade(md.Type, codec, payload)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade %s to schema version %d: %w", md.Type, version, err)
+		}
+		md.SchemaVersion = version
+	}
+	return payload, nil
+}
+
+// upgradeSaga upgrades the input of the saga and the payloads of its steps. It
+// returns false if no upgrade applied to them.
+func (d *SagaDefinition) upgradeSaga(saga *Saga) (bool, error) {
+	start, _ := d.startTransition()
+	md := Metadata{Type: typeName(start.Event), Codec: saga.PayloadCodec, SchemaVersion: saga.PayloadSchemaVersion}
+	payload, err := d.upgrade(&md, saga.Payload)
+	if err != nil {
+		return false, err
+	}
+	upgraded := md.SchemaVersion != saga.PayloadSchemaVersion
+	saga.Payload = payload
+	saga.PayloadSchemaVersion = md.SchemaVersion
+
+	for i := range saga.Steps {
+		step := &saga.Steps[i]
+		version := step.RequestMetadata.SchemaVersion
+		if step.RequestPayload, err = d.upgrade(&step.RequestMetadata, step.RequestPayload); err != nil {
+			return false, err
+		}
+		upgraded = upgraded || step.RequestMetadata.SchemaVersion != version
+		version = step.ResponseMetadata.SchemaVersion
+		if step.ResponsePayload, err = d.upgrade(&step.ResponseMetadata, step.ResponsePayload); err != nil {
+			return false, err
+		}
+		upgraded = upgraded || step.ResponseMetadata.SchemaVersion != version
+	}
+	return upgraded, nil
+}
+
+// AddGroup appends a group of parallel steps to the saga.
+func (d *SagaDefinition) AddGroup(group *StepGroup) *SagaDefinition {
+	for _, step := range group.Steps {
+		step.group = group
+		d.Steps = append(d.Steps, step)
+	}
+	return d
+}
+
+// stages returns the steps in the order the saga waits for them, with the
+// steps of a group in the same stage.
+func (d *SagaDefinition) stages() []stage {
+	var stages []stage
+	for _, step := range d.Steps {
+		if n := len(stages); n > 0 && step.group != nil && stages[n-1].group == step.group {
+			stages[n-1].steps = append(stages[n-1].steps, step)
+			continue
+		}
+		stages = append(stages, stage{
+			group: step.group,
+			steps: []*StepDefinition{step},
+		})
+	}
+	return stages
+}
+
+// Validate checks that the definition can be executed by the coordinator.
+func (d *SagaDefinition) Validate() error {
+	if d.Name == "" {
+		return errors.New("saga definition name is required")
+	}
+	if len(d.Steps) == 0 {
+		return fmt.Errorf("saga definition %q has no steps", d.Name)
+	}
+	if d.Version == 0 {
+		return fmt.Errorf("saga definition %q has no version", d.Name)
+	}
+	if d.Version == 1 && d.Migrate != nil {
+		return fmt.Errorf("saga definition %q has no previous version to migrate", d.Name)
+	}
+	if _, err := lookupCodec(d.codec().Name()); err != nil {
+		return fmt.Errorf("saga definition %q codec %q is not registered", d.Name, d.codec().Name())
+	}
+	if d.SchemaVersion < 0 {
+		return fmt.Errorf("saga definition %q has invalid schema version %d", d.Name, d.SchemaVersion)
+	}
+	for version := range d.Upgrades {
+		if version <= 1 || version > d.schemaVersion() {
+			return fmt.Errorf("saga definition %q has upgrade to invalid schema version %d", d.Name, version)
+		}
+	}
+
+	steps := make(map[string]bool)
+	events := make(map[reflect.Type]bool)
+	var pivot *StepDefinition
+	for _, step := range d.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("saga definition %q has a step without a name", d.Name)
+		}
+		if steps[step.Name] {
+			return fmt.Errorf("saga definition %q has duplicate step %q", d.Name, step.Name)
+		}
+		steps[step.Name] = true
+
+		switch step.Kind {
+		case StepCompensatable:
+			if pivot != nil {
+				return fmt.Errorf("saga definition %q step %q after pivot %q is not retriable", d.Name, step.Name, pivot.Name)
+			}
+		case StepPivot:
+			if pivot != nil {
+				return fmt.Errorf("saga definition %q has pivots %q and %q", d.Name, pivot.Name, step.Name)
+			}
+			if step.group != nil {
+				return fmt.Errorf("saga definition %q pivot %q is in group %q", d.Name, step.Name, step.group.Name)
+			}
+			pivot = step
+		case StepRetriable:
+			if pivot == nil {
+				return fmt.Errorf("saga definition %q step %q is retriable before the pivot", d.Name, step.Name)
+			}
+		default:
+			return fmt.Errorf("saga definition %q step %q has invalid kind %d", d.Name, step.Name, step.Kind)
+		}
+		if step.CommandMapper != nil && step.Command == nil {
+			return fmt.Errorf("saga definition %q step %q maps a command, but invokes none", d.Name, step.Name)
+		}
+		if step.CompensationMapper != nil && step.Compensation == nil {
+			return fmt.Errorf("saga definition %q step %q maps a compensation, but has none", d.Name, step.Name)
+		}
+		if step.Kind != StepCompensatable && step.Compensation != nil {
+			return fmt.Errorf("saga definition %q step %q cannot be compensated", d.Name, step.Name)
+		}
+
+		for _, t := range step.Transitions {
+			if !t.From.Valid() || !t.To.Valid() {
+				return fmt.Errorf("saga definition %q step %q has invalid transition from %q to %q", d.Name, step.Name, t.From, t.To)
+			}
+			// A step that cannot be compensated is never undone once it has
+			// succeeded.
+			if step.Kind != StepCompensatable && t.From == StepStatusSuccess {
+				return fmt.Errorf("saga definition %q step %q cannot be compensated, but has transition from %q", d.Name, step.Name, t.From)
+			}
+			typ := eventType(t.Event)
+			if events[typ] {
+				return fmt.Errorf("saga definition %q handles event %s more than once", d.Name, typ)
+			}
+			events[typ] = true
+		}
+	}
+	if _, ok := d.startTransition(); !ok {
+		return fmt.Errorf("saga definition %q has no success event for step %q", d.Name, d.Steps[0].Name)
+	}
+	if d.Steps[0].Condition != nil {
+		return fmt.Errorf("saga definition %q has a condition on step %q", d.Name, d.Steps[0].Name)
+	}
+	if d.Steps[0].group != nil {
+		return fmt.Errorf("saga definition %q starts with group %q", d.Name, d.Steps[0].group.Name)
+	}
+
+	groups := make(map[string]bool)
+	for _, stage := range d.stages() {
+		group := stage.group
+		if group == nil {
+			continue
+		}
+		if group.Name == "" {
+			return fmt.Errorf("saga definition %q has a group without a name", d.Name)
+		}
+		if groups[group.Name] {
+			return fmt.Errorf("saga definition %q has duplicate group %q", d.Name, group.Name)
+		}
+		groups[group.Name] = true
+		if len(stage.steps) != len(group.Steps) {
+			return fmt.Errorf("saga definition %q has steps between the steps of group %q", d.Name, group.Name)
+		}
+		if group.Required < 0 || group.Required > len(group.Steps) {
+			return fmt.Errorf("saga definition %q group %q requires %d of %d steps", d.Name, group.Name, group.Required, len(group.Steps))
+		}
+	}
+	return nil
+}
+
+// NewSaga creates a new saga instance with all steps pending.
+func (d *SagaDefinition) NewSaga(id string) *Saga {
+	steps := make([]Step, len(d.Steps))
+	for i, step := range d.Steps {
+		steps[i] = Step{Name: step.Name, Status: StepStatusPending}
+		if step.group != nil {
+			steps[i].Group = step.group.Name
+			steps[i].Required = step.group.Required
+		}
+	}
+	return &Saga{
+		ID:      id,
+		Name:    d.Name,
+		Version: d.Version,
+		Status:  SagaStatusPending,
+		Steps:   steps,
+	}
+}
+
+// conforms returns an error if the steps of the saga are not the steps of the
+// definition, in the same order.
+func (d *SagaDefinition) conforms(saga *Saga) error {
+	if len(saga.Steps) != len(d.Steps) {
+		return fmt.Errorf("saga %q has %d steps, but definition %q version %d has %d", saga.ID, len(saga.Steps), d.Name, d.Version, len(d.Steps))
+	}
+	for i, step := range d.Steps {
+		if saga.Steps[i].Name != step.Name {
+			return fmt.Errorf("saga %q has step %q, but definition %q version %d has step %q", saga.ID, saga.Steps[i].Name, d.Name, d.Version, step.Name)
+		}
+	}
+	return nil
+}
+
+// GetStep returns the definition of the step with the given name.
+func (d *SagaDefinition) GetStep(name string) (*StepDefinition, error) {
+	for _, step := range d.Steps {
+		if step.Name == name {
+			return step, nil
+		}
+	}
+	return nil, errors.New("step definition not found")
+}
+
+// Starts returns true if the event starts a new saga.
+func (d *SagaDefinition) Starts(evt event) bool {
+	t, ok := d.startTransition()
+	return ok && eventType(t.Event) == eventType(evt)
+}
+
+// Transition returns the step and the transition the event triggers.
+func (d *SagaDefinition) Transition(evt event) (*StepDefinition, Transition, bool) {
+	typ := eventType(evt)
+	for _, step := range d.Steps {
+		for _, t := range step.Transitions {
+			if eventType(t.Event) == typ {
+				return step, t, true
+			}
+		}
+	}
+	return nil, Transition{}, false
+}
+
+// lookupEvent returns the event registered with the given type name.
+func (d *SagaDefinition) lookupEvent(name string) (event, bool) {
+	for _, step := range d.Steps {
+		for _, t := range step.Transitions {
+			if typeName(t.Event) == name {
+				return t.Event, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (d *SagaDefinition) startTransition() (Transition, bool) {
+	if len(d.Steps) == 0 {
+		return Transition{}, false
+	}
+	for _, t := range d.Steps[0].Transitions {
+		if t.From == StepStatusPending && t.To == StepStatusSuccess {
+			return t, true
+		}
+	}
+	return Transition{}, false
+}
+
+// eventType returns the underlying type of the event, so that both values and
+// pointers match the same transition.
+func eventType(evt event) reflect.Type {
+	typ := reflect.TypeOf(evt)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// decodeEvent decodes the payload into a new event of the same type as the
+// prototype, with the codec registered with the name.
+func decodeEvent(codec string, proto event, payload []byte) (event, error) {
+	v := reflect.New(eventType(proto))
+	if err := unmarshal(codec, payload, v.Interface()); err != nil {
+		return nil, err
+	}
+	if evt, ok := v.Elem().Interface().(event); ok {
+		return evt, nil
+	}
+	return v.Interface().(event), nil
+}
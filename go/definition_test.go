@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSagaDefinition(t *testing.T) {
+	t.Run("when definition is valid", func(t *testing.T) {
+		assert.Nil(t, NewBookingSagaDefinition().Validate())
+	})
+
+	t.Run("when step is duplicated", func(t *testing.T) {
+		def := NewSagaDefinition("booking-saga").
+			AddStep(NewStepDefinition("create-booking").OnSuccess(BookingCreated{})).
+			AddStep(NewStepDefinition("create-booking").OnSuccess(PaymentCreated{}))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when event is handled twice", func(t *testing.T) {
+		def := NewSagaDefinition("booking-saga").
+			AddStep(NewStepDefinition("create-booking").OnSuccess(BookingCreated{})).
+			AddStep(NewStepDefinition("create-payment").OnSuccess(BookingCreated{}))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when first step has no success event", func(t *testing.T) {
+		def := NewSagaDefinition("booking-saga").
+			AddStep(NewStepDefinition("create-booking").OnFailure(BookingRejected{}))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when a step cannot be compensated", func(t *testing.T) {
+		newStep := func(name string) *StepDefinition {
+			return NewStepDefinition(name).Invoke(ConfirmBookingCommand{})
+		}
+		defs := map[string]*SagaDefinition{
+			"pivot with compensation": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking").AsPivot().WithCompensation(RefundPaymentCommand{})),
+			"retriable with compensation": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").AsPivot().OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking").AsRetriable().WithCompensation(RefundPaymentCommand{})),
+			"pivot with compensated event": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking").AsPivot().On(BookingRejected{}, StepStatusSuccess, StepStatusFailed)),
+			"retriable before pivot": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking").AsRetriable()),
+			"compensatable after pivot": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").AsPivot().OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking")),
+			"two pivots": NewSagaDefinition("booking-saga").
+				AddStep(NewStepDefinition("create-booking").AsPivot().OnSuccess(BookingCreated{})).
+				AddStep(newStep("confirm-booking").AsPivot()),
+		}
+
+		for name, def := range defs {
+			assert.NotNil(t, def.Validate(), name)
+		}
+	})
+
+	t.Run("when matching events", func(t *testing.T) {
+		assert := assert.New(t)
+		def := NewBookingSagaDefinition()
+
+		assert.True(def.Starts(BookingCreated{}))
+		assert.True(def.Starts(&BookingCreated{}))
+		assert.False(def.Starts(PaymentCreated{}))
+
+		step, transition, ok := def.Transition(&PaymentRefunded{})
+		assert.True(ok)
+		assert.Equal("create-payment", step.Name)
+		assert.Equal(StepStatusSuccess, transition.From)
+		assert.Equal(StepStatusCompensated, transition.To)
+	})
+
+	t.Run("when creating a saga", func(t *testing.T) {
+		assert := assert.New(t)
+		saga := NewBookingSagaDefinition().NewSaga("1")
+
+		assert.Equal("booking-saga", saga.Name)
+		assert.Len(saga.Steps, 3)
+		for _, step := range saga.Steps {
+			assert.Equal(StepStatusPending, step.Status)
+		}
+	})
+}
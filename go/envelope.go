@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version of the envelope and payload format written by
+// the coordinator, unless the saga definition sets its own.
+const SchemaVersion = 1
+
+// Metadata describes a message independently of its payload.
+type Metadata struct {
+	MessageID string
+	// CorrelationID is the id of the saga the message belongs to.
+	CorrelationID string
+	// CausationID is the id of the message that caused this message.
+	CausationID string
+	Type        string
+	Timestamp   time.Time
+	// Codec is the name of the codec of the payload, and SchemaVersion is
+	// the version of its schema.
+	Codec         string
+	SchemaVersion int
+	Headers       map[string]string
+}
+
+// Value stores the metadata as JSON.
+func (m Metadata) Value() (driver.Value, error) {
+	if m.MessageID == "" {
+		return nil, nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	default:
+		return fmt.Errorf("cannot scan %T into metadata", src)
+	}
+}
+
+func (m Metadata) clone() Metadata {
+	if m.Headers != nil {
+		headers := make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+		m.Headers = headers
+	}
+	return m
+}
+
+// Envelope wraps every command and event.
+type Envelope struct {
+	Metadata
+	Payload []byte
+}
+
+// CommandEnvelope is the envelope of a command sent for a step.
+// Compensation is true for the command that undoes the step.
+type CommandEnvelope struct {
+	Envelope
+	Step         string
+	Compensation bool
+}
+
+// NewEventEnvelope wraps the event encoded as JSON, correlated to the saga it
+// belongs to.
+func NewEventEnvelope(evt event) (Envelope, error) {
+	return NewEventEnvelopeWith(JSONCodec{}, SchemaVersion, evt)
+}
+
+// NewEventEnvelopeWith wraps the event encoded with the codec, in the given
+// version of its schema.
+func NewEventEnvelopeWith(codec Codec, schemaVersion int, evt event) (Envelope, error) {
+	return newEnvelope(codec, schemaVersion, evt.sagaID(), "", evt)
+}
+
+// NewReplyEnvelope wraps the event that replies to the command, encoded with
+// the codec and schema version of the command, and caused by the command. The
+// reply carries the headers of the command, e.g. a trace context.
+func NewReplyEnvelope(cmd CommandEnvelope, evt event) (Envelope, error) {
+	codec, err := lookupCodec(cmd.Codec)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env, err := newEnvelope(codec, cmd.SchemaVersion, cmd.CorrelationID, cmd.MessageID, evt)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env.Headers = cmd.Metadata.clone().Headers
+	return env, nil
+}
+
+func newEnvelope(codec Codec, schemaVersion int, correlationID, causationID string, msg interface{}) (Envelope, error) {
+	id, err := UUIDGenerator{}.NewID()
+	if err != nil {
+		return Envelope{}, err
+	}
+	b, err := codec.Marshal(msg)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Metadata: Metadata{
+			MessageID:     id,
+			CorrelationID: correlationID,
+			CausationID:   causationID,
+			Type:          typeName(msg),
+			Timestamp:     time.Now(),
+			Codec:         codec.Name(),
+			SchemaVersion: schemaVersion,
+		},
+		Payload: b,
+	}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when wrapping an event", func(t *testing.T) {
+		assert := assert.New(t)
+
+		env, err := NewEventEnvelope(PaymentCreated{ID: "1"})
+		assert.Nil(err)
+		assert.NotEmpty(env.MessageID)
+		assert.Equal("1", env.CorrelationID)
+		assert.Equal("PaymentCreated", env.Type)
+		assert.Equal(SchemaVersion, env.SchemaVersion)
+		assert.False(env.Timestamp.IsZero())
+		assert.Equal(`{"ID":"1"}`, string(env.Payload))
+	})
+
+	t.Run("when replying to a command", func(t *testing.T) {
+		assert := assert.New(t)
+		cmd := CommandEnvelope{
+			Envelope: Envelope{
+				Metadata: Metadata{
+					MessageID:     "2",
+					CorrelationID: "1",
+					Codec:         "json",
+					SchemaVersion: SchemaVersion,
+					Headers:       map[string]string{"trace-id": "abc"},
+				},
+			},
+			Step: "create-payment",
+		}
+
+		env, err := NewReplyEnvelope(cmd, PaymentCreated{ID: "1"})
+		assert.Nil(err)
+		assert.Equal("1", env.CorrelationID)
+		assert.Equal("2", env.CausationID)
+
+		// Then the reply carries a copy of the headers of the command.
+		assert.Equal(map[string]string{"trace-id": "abc"}, env.Headers)
+		env.Headers["trace-id"] = "def"
+		assert.Equal("abc", cmd.Headers["trace-id"])
+	})
+
+	t.Run("when handling messages", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+		env, err := NewEventEnvelope(PaymentCreated{ID: "1"})
+		require.Nil(t, err)
+		env.Headers = map[string]string{"trace-id": "abc"}
+
+		saga, err = sec.HandleMessage(ctx, env)
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+		// Then the metadata is stored with the response.
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err := found.GetStep("create-payment")
+		assert.Nil(err)
+		assert.Equal(env.MessageID, step.ResponseMetadata.MessageID)
+		assert.Equal("abc", step.ResponseMetadata.Headers["trace-id"])
+
+		// And the next command is caused by the event.
+		commands := pub.Commands()
+		assert.Len(commands, 2)
+		assert.Equal(env.MessageID, commands[1].CausationID)
+		assert.Equal("1", commands[1].CorrelationID)
+
+		// When the event is delivered again.
+		_, err = sec.HandleMessage(ctx, env)
+		assert.ErrorIs(err, ErrDuplicateMessage)
+
+		// Then the saga is not modified.
+		again, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(found.Revision, again.Revision)
+	})
+
+	t.Run("when the event type is unknown", func(t *testing.T) {
+		sec := NewExecutionCoordinator(NewInMemoryStore(), NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		_, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+
+		_, err = sec.HandleMessage(ctx, Envelope{
+			Metadata: Metadata{
+				MessageID:     "2",
+				CorrelationID: "1",
+				Type:          "DeliveryCreated",
+			},
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("when messages are run", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithProcessedMessages(store)
+
+		created, err := NewEventEnvelope(BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		paid, err := NewEventEnvelope(PaymentCreated{ID: "1"})
+		require.Nil(t, err)
+		messages := make(chan Envelope, 3)
+		messages <- created
+		messages <- created
+		messages <- paid
+		close(messages)
+
+		sagas := make(chan *Saga, 3)
+		assert.Nil(sec.RunMessages(ctx, messages, sagas))
+		close(sagas)
+
+		// Then the duplicate is skipped.
+		var revisions []uint
+		for saga := range sagas {
+			revisions = append(revisions, saga.Revision)
+		}
+		assert.Equal([]uint{1, 2}, revisions)
+	})
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
 )
 
 type repository interface {
@@ -12,234 +15,715 @@ type repository interface {
 	UpdateSaga(ctx context.Context, saga *Saga) (Saga, error)
 }
 
-type ExecutionCoordinator struct {
-	repo repository
-}
+// maxEventAttempts bounds how many times an event is reapplied when the saga is
+// modified concurrently.
+const maxEventAttempts = 3
 
-func NewExecutionCoordinator(repo repository) *ExecutionCoordinator {
-	return &ExecutionCoordinator{
-		repo: repo,
+type ExecutionCoordinator struct {
+	repo      repository
+	publisher CommandPublisher
+	outbox    bool
+	processed ProcessedMessages
+	// processedInTx is set when the processed messages are recorded by the
+	// repository, in the transaction of the saga update.
+	processedInTx bool
+	// compensationRetry is the retry policy of every compensation command.
+	compensationRetry RetryPolicy
+	// definitions are the registered versions of each saga definition, and
+	// latest is the version new sagas start on.
+	definitions map[string]map[uint]*SagaDefinition
+	latest      map[string]*SagaDefinition
+}
+
+// NewExecutionCoordinator creates a coordinator that runs the given saga
+// definitions, and sends the commands of each step with the publisher. Several
+// versions of a definition may be registered: new sagas start on the latest,
+// and sagas in flight continue on the version they started on, unless a later
+// version migrates them. It panics if a definition is invalid or registered
+// twice.
+func NewExecutionCoordinator(repo repository, publisher CommandPublisher, defs ...*SagaDefinition) *ExecutionCoordinator {
+	ec := &ExecutionCoordinator{
+		repo:              repo,
+		publisher:         publisher,
+		compensationRetry: DefaultCompensationRetryPolicy,
+		definitions:       make(map[string]map[uint]*SagaDefinition),
+		latest:            make(map[string]*SagaDefinition),
+	}
+	for _, def := range defs {
+		if err := def.Validate(); err != nil {
+			panic(err)
+		}
+		versions, ok := ec.definitions[def.Name]
+		if !ok {
+			versions = make(map[uint]*SagaDefinition)
+			ec.definitions[def.Name] = versions
+		}
+		if _, ok := versions[def.Version]; ok {
+			panic(fmt.Sprintf("saga definition %q version %d registered twice", def.Name, def.Version))
+		}
+		versions[def.Version] = def
+		if latest, ok := ec.latest[def.Name]; !ok || latest.Version < def.Version {
+			ec.latest[def.Name] = def
+		}
 	}
+	return ec
 }
 
-func (ec *ExecutionCoordinator) CompensationFlow(ctx context.Context, saga Saga) error {
-	_, err := ec.rejectBooking(ctx, saga)
-	if err != nil {
-		return err
+// WithOutbox writes the commands to the outbox of the repository, in the same
+// transaction as the saga, instead of publishing them directly. The commands
+// are then sent by the OutboxRelay of the coordinator, which escalates the
+// compensations that keep failing. It panics if the repository does not
+// implement Outbox.
+func (ec *ExecutionCoordinator) WithOutbox() *ExecutionCoordinator {
+	if _, ok := ec.repo.(Outbox); !ok {
+		panic(fmt.Sprintf("repository %T does not implement Outbox", ec.repo))
 	}
-
-	_, err = ec.refundPayment(ctx, saga)
-	if err != nil {
-		return err
+	ec.outbox = true
+	return ec
+}
+
+// WithProcessedMessages records the messages handled by the coordinator, so
+// that messages delivered again are acknowledged without being applied. If
+// processed is the repository, a message is recorded in the same transaction
+// as the update of its saga, or on its own if it does not change the saga.
+// Otherwise it is recorded after the update, and a message may be applied
+// twice if the coordinator stops in between.
+func (ec *ExecutionCoordinator) WithProcessedMessages(processed ProcessedMessages) *ExecutionCoordinator {
+	ec.processed = processed
+	repo, ok := ec.repo.(ProcessedMessages)
+	ec.processedInTx = ok && repo == processed
+	return ec
+}
+
+// WithCompensationRetry sets the policy for sending compensation commands
+// again. Compensations must eventually succeed, so they are retried
+// indefinitely, and the saga is marked as stuck after MaxAttempts.
+func (ec *ExecutionCoordinator) WithCompensationRetry(policy RetryPolicy) *ExecutionCoordinator {
+	ec.compensationRetry = policy
+	return ec
+}
+
+func (ec *ExecutionCoordinator) definition(name string, version uint) (*SagaDefinition, error) {
+	def, ok := ec.definitions[name][version]
+	if !ok {
+		return nil, fmt.Errorf("saga definition %q version %d not found", name, version)
 	}
-
-	_, err = ec.cancelBooking(ctx, saga)
-	if err != nil {
-		return err
+	return def, nil
+}
+
+// Router returns a router that dispatches the events of every registered saga
+// definition to HandleEvent. The routed events are not deduplicated, so
+// events received from a broker should be handled with RunMessages instead.
+func (ec *ExecutionCoordinator) Router() *EventRouter {
+	r := NewEventRouter()
+	// The versions of a definition share most of their events.
+	events := make(map[reflect.Type]bool)
+	for _, versions := range ec.definitions {
+		for _, def := range versions {
+			for _, step := range def.Steps {
+				for _, t := range step.Transitions {
+					if typ := eventType(t.Event); !events[typ] {
+						events[typ] = true
+						r.Handle(t.Event, ec.HandleEvent)
+					}
+				}
+			}
+		}
+	}
+	r.Handle(StepTimedOut{}, ec.HandleEvent)
+	r.Handle(CompensationResolved{}, ec.HandleEvent)
+	return r
+}
+
+// Continue runs the flow that matches the status derived from the steps.
+func (ec *ExecutionCoordinator) Continue(ctx context.Context, saga Saga) error {
+	switch status := saga.CheckStatus(); status {
+	case SagaStatusPending:
+		return ec.ForwardFlow(ctx, saga)
+	case SagaStatusCompensating:
+		return ec.CompensationFlow(ctx, saga)
+	default:
+		if saga.Status == status {
+			return nil
+		}
+		return ec.updateStatus(ctx, &saga)
 	}
-
-	saga.Status = saga.CheckStatus()
-	_, err = ec.repo.UpdateSaga(ctx, &saga)
-	return err
 }
 
-func (ec *ExecutionCoordinator) BookingFlow(ctx context.Context, saga Saga) error {
-	createBookingStep, err := ec.createBooking(ctx, saga)
-	if err != nil {
-		return err
-	}
-	if createBookingStep.Status != "success" {
-		return nil
+// RunFlows continues the flow of each saga, until the sagas channel is closed
+// or the context is done. Flows that fail are logged and skipped.
+func (ec *ExecutionCoordinator) RunFlows(ctx context.Context, sagas <-chan *Saga) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case saga, ok := <-sagas:
+			if !ok {
+				return nil
+			}
+			if err := ec.Continue(ctx, *saga); err != nil {
+				log.Printf("failed to continue saga %s: %s\n", saga.ID, err)
+			}
+		}
 	}
+}
 
-	createPaymentStep, err := ec.createPayment(ctx, saga)
-	if err != nil {
-		return err
-	}
-	if createPaymentStep.Status != "success" {
-		return nil
+// RunMessages handles the messages, and sends the sagas they updated, until
+// the messages channel is closed or the context is done. Duplicate messages
+// are skipped, and messages that fail are logged and skipped.
+func (ec *ExecutionCoordinator) RunMessages(ctx context.Context, messages <-chan Envelope, sagas chan<- *Saga) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case env, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			saga, err := ec.HandleMessage(ctx, env)
+			if errors.Is(err, ErrDuplicateMessage) {
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to handle message %s: %s\n", env.MessageID, err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case sagas <- saga:
+			}
+		}
 	}
+}
 
-	confirmBookingStep, err := ec.confirmBooking(ctx, saga)
+// CompensationFlow undoes the successful steps in reverse order. Each step
+// waits for its compensation event before the previous step is compensated,
+// unless the definition compensates in parallel.
+func (ec *ExecutionCoordinator) CompensationFlow(ctx context.Context, saga Saga) error {
+	def, err := ec.definition(saga.Name, saga.Version)
 	if err != nil {
 		return err
 	}
-	if confirmBookingStep.Status != "success" {
-		return nil
+	if def.Compensation == CompensateInParallel {
+		return ec.parallelCompensationFlow(ctx, def, saga)
 	}
 
-	saga.Status = saga.CheckStatus()
-	_, err = ec.repo.UpdateSaga(ctx, &saga)
-	return err
-}
-
-type CreateBookingCommand struct {
-}
-
-func (c CreateBookingCommand) isCommand() {}
-
-func (ec *ExecutionCoordinator) createBooking(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "create-booking", "pending", "success", CreateBookingCommand{})
-}
-
-type CreatePaymentCommand struct {
-}
-
-func (c CreatePaymentCommand) isCommand() {}
-
-func (ec *ExecutionCoordinator) createPayment(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "create-payment", "pending", "success", CreatePaymentCommand{})
-}
-
-type ConfirmBookingCommand struct {
-}
-
-func (c ConfirmBookingCommand) isCommand() {}
+	for i := len(def.Steps) - 1; i >= 0; i-- {
+		stepDef := def.Steps[i]
+		step, err := saga.GetStep(stepDef.Name)
+		if err != nil {
+			return err
+		}
+		// A parallel step that is still waiting for its event may succeed,
+		// and is undone before the previous steps.
+		if step.awaiting() {
+			return nil
+		}
+		// Only successful steps need to be undone.
+		if step.Status != StepStatusSuccess && step.Status != StepStatusCompensated {
+			continue
+		}
+		// There is nothing to undo, so the step is compensated right away.
+		if stepDef.Compensation == nil {
+			if err := ec.skipCompensation(ctx, &saga, step); err != nil {
+				return err
+			}
+			continue
+		}
 
-func (ec *ExecutionCoordinator) confirmBooking(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "confirm-booking", "pending", "success", ConfirmBookingCommand{})
-}
+		compensatedStep, err := ec.handleCommand(ctx, &saga, stepDef, StepStatusSuccess, StepStatusCompensated)
+		if err != nil {
+			return err
+		}
+		if compensatedStep.Status != StepStatusCompensated {
+			return nil
+		}
+	}
 
-type RejectBookingCommand struct {
+	return ec.updateStatus(ctx, &saga)
 }
 
-func (c RejectBookingCommand) isCommand() {}
+// parallelCompensationFlow sends the compensation commands of all the
+// successful steps at once. The saga is compensated once every compensation
+// event has arrived. Commands that have been sent are only sent again when
+// their retry is due, and a command that fails does not prevent the others
+// from being sent.
+func (ec *ExecutionCoordinator) parallelCompensationFlow(ctx context.Context, def *SagaDefinition, saga Saga) error {
+	var firstErr error
+	for i := len(def.Steps) - 1; i >= 0; i-- {
+		stepDef := def.Steps[i]
+		step, err := saga.GetStep(stepDef.Name)
+		if err != nil {
+			return err
+		}
+		// Steps still waiting for their event are undone once they succeed.
+		if step.Status != StepStatusSuccess {
+			continue
+		}
+		if stepDef.Compensation == nil {
+			if err := ec.skipCompensation(ctx, &saga, step); err != nil {
+				return err
+			}
+			continue
+		}
+		if step.sent(stepDef.Compensation) && step.NextRetry == nil {
+			continue
+		}
+		if _, err := ec.handleCommand(ctx, &saga, stepDef, StepStatusSuccess, StepStatusCompensated); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
 
-func (ec *ExecutionCoordinator) rejectBooking(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "confirm-booking", "success", "failed", RejectBookingCommand{})
+	return ec.updateStatus(ctx, &saga)
 }
 
-type RefundPaymentCommand struct {
-}
+// ForwardFlow executes the steps in order. Each step waits for its success
+// event before the next step is executed. The commands of a group of parallel
+// steps are sent together, and the group waits for the success events of the
+// required number of steps.
+func (ec *ExecutionCoordinator) ForwardFlow(ctx context.Context, saga Saga) error {
+	def, err := ec.definition(saga.Name, saga.Version)
+	if err != nil {
+		return err
+	}
 
-func (c RefundPaymentCommand) isCommand() {}
+	for _, stage := range def.stages() {
+		for _, stepDef := range stage.steps {
+			step, err := saga.GetStep(stepDef.Name)
+			if err != nil {
+				return err
+			}
+			if step.Status == StepStatusSkipped {
+				continue
+			}
+			// The other steps of a group may fail while a step is waiting
+			// for its event. A step waiting for its event is only sent again
+			// when its retry is due.
+			if stage.group != nil && (step.Status == StepStatusFailed || step.awaiting() && step.NextRetry == nil) {
+				continue
+			}
+			// The condition is evaluated once, before the command is sent.
+			if stepDef.Condition != nil && step.Status == StepStatusPending && step.RequestPayload == nil {
+				ok, err := stepDef.Condition(saga)
+				if err != nil {
+					return fmt.Errorf("condition of step %q: %w", step.Name, err)
+				}
+				if !ok {
+					if err := ec.skip(ctx, &saga, step, StepStatusSkipped); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if _, err := ec.handleCommand(ctx, &saga, stepDef, StepStatusPending, StepStatusSuccess); err != nil {
+				return err
+			}
+		}
 
-func (ec *ExecutionCoordinator) refundPayment(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "create-payment", "success", "compensated", RefundPaymentCommand{})
-}
+		switch status := saga.CheckStatus(); {
+		// A step failed, or its command could not be sent and will not be
+		// retried.
+		case status != SagaStatusPending && status != SagaStatusCompleted:
+			return ec.Continue(ctx, saga)
+		case !stageDone(&saga, stage):
+			return nil
+		}
+	}
 
-type CancelBookingCommand struct {
+	return ec.updateStatus(ctx, &saga)
 }
 
-func (c CancelBookingCommand) isCommand() {}
-
-func (ec *ExecutionCoordinator) cancelBooking(ctx context.Context, saga Saga) (*Step, error) {
-	return ec.handleCommand(ctx, saga, "create-booking", "success", "compensated", CancelBookingCommand{})
+// stageDone returns true if the required steps of the stage have succeeded.
+func stageDone(saga *Saga, stage stage) bool {
+	required := len(stage.steps)
+	if stage.group != nil && stage.group.Required > 0 {
+		required = stage.group.Required
+	}
+	var success int
+	for _, stepDef := range stage.steps {
+		if step, err := saga.GetStep(stepDef.Name); err == nil && (step.Status == StepStatusSuccess || step.Status == StepStatusSkipped) {
+			success++
+		}
+	}
+	return success >= required
 }
 
-type BookingCreated struct {
-	ID string
+// updateStatus saves the status derived from the steps, if it has changed.
+func (ec *ExecutionCoordinator) updateStatus(ctx context.Context, saga *Saga) error {
+	status := saga.Status
+	if err := saga.syncStatus(); err != nil {
+		return err
+	}
+	if saga.Status == status {
+		return nil
+	}
+	_, err := ec.repo.UpdateSaga(ctx, saga)
+	return err
 }
 
-func (e BookingCreated) isEvent() {}
-
-func (ec *ExecutionCoordinator) onBookingCreated(ctx context.Context, event BookingCreated) (*Saga, error) {
-	saga := NewBookingSaga(event.ID)
-	return ec.handleEvent(ctx, saga, "create-booking", "pending", "success", event)
+// skipCompensation marks a successful step without compensation command as
+// compensated.
+func (ec *ExecutionCoordinator) skipCompensation(ctx context.Context, saga *Saga, step Step) error {
+	if step.Status != StepStatusSuccess {
+		return nil
+	}
+	return ec.skip(ctx, saga, step, StepStatusCompensated)
 }
 
-type BookingCancelled struct {
-	ID string
+// skip moves the step to the given status without sending a command, and
+// saves the saga.
+func (ec *ExecutionCoordinator) skip(ctx context.Context, saga *Saga, step Step, to StepStatus) error {
+	step.Status = to
+	if err := saga.UpdateStep(step); err != nil {
+		return err
+	}
+	saga.record(LogRecord{
+		Type:       LogRecordSkip,
+		Step:       step.Name,
+		StepStatus: step.Status,
+	})
+	if err := saga.syncStatus(); err != nil {
+		return err
+	}
+	updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
+	if err != nil {
+		return err
+	}
+	*saga = updatedSaga
+	return nil
 }
 
-func (e BookingCancelled) isEvent() {}
-
-func (ec *ExecutionCoordinator) onBookingCancelled(ctx context.Context, event BookingCancelled) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+// HandleEvent wraps the event in a new envelope and handles it. Every call is
+// a new message, so an event delivered twice is not deduplicated: events
+// received from a broker should be handled with HandleMessage, in the
+// envelope they were delivered in.
+func (ec *ExecutionCoordinator) HandleEvent(ctx context.Context, evt event) (*Saga, error) {
+	codec, schemaVersion := ec.eventCodec(evt)
+	env, err := NewEventEnvelopeWith(codec, schemaVersion, evt)
 	if err != nil {
 		return nil, err
 	}
-	return ec.handleEvent(ctx, &saga, "create-booking", "success", "compensated", event)
-}
-
-type PaymentCreated struct {
-	ID string
+	return ec.HandleMessage(ctx, env)
 }
 
-func (e PaymentCreated) isEvent() {}
+// eventCodec returns the codec and schema version of the saga that handles
+// the event, preferring the latest versions of the definitions. Events
+// handled by the coordinator itself are JSON.
+func (ec *ExecutionCoordinator) eventCodec(evt event) (Codec, int) {
+	for _, def := range ec.latest {
+		if _, _, ok := def.Transition(evt); ok {
+			return def.codec(), def.schemaVersion()
+		}
+	}
+	for _, versions := range ec.definitions {
+		for _, def := range versions {
+			if _, _, ok := def.Transition(evt); ok {
+				return def.codec(), def.schemaVersion()
+			}
+		}
+	}
+	return JSONCodec{}, SchemaVersion
+}
+
+// HandleMessage applies the transition registered for the event in the
+// envelope to the saga the event is correlated to. The success event of the
+// first step starts a new saga.
+//
+// Messages that have already been processed, or already applied to their
+// step, are not applied again, and ErrDuplicateMessage is returned so that
+// the caller does not continue the flow of the saga.
+func (ec *ExecutionCoordinator) HandleMessage(ctx context.Context, env Envelope) (*Saga, error) {
+	if ec.processed != nil {
+		processed, err := ec.processed.Processed(ctx, env.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		if processed {
+			return nil, ErrDuplicateMessage
+		}
+	}
 
-func (ec *ExecutionCoordinator) onPaymentCreated(ctx context.Context, event PaymentCreated) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+	saga, err := ec.handleMessage(ctx, env)
 	if err != nil {
 		return nil, err
 	}
-	return ec.handleEvent(ctx, &saga, "create-payment", "pending", "success", event)
+	// A message that left the saga unchanged was not recorded with an
+	// update.
+	if ec.processed != nil && (!ec.processedInTx || saga.processed != "") {
+		if err := ec.processed.MarkProcessed(ctx, env.MessageID); err != nil {
+			return nil, err
+		}
+		saga.processed = ""
+	}
+	return saga, nil
 }
 
-type PaymentFailed struct {
-	ID string
-}
+// handleMessage reapplies the message up to maxEventAttempts times if the saga
+// is modified concurrently.
+func (ec *ExecutionCoordinator) handleMessage(ctx context.Context, env Envelope) (*Saga, error) {
+	for _, def := range ec.latest {
+		proto, ok := def.lookupEvent(env.Type)
+		if !ok || !def.Starts(proto) {
+			continue
+		}
+		payload, err := def.upgrade(&env.Metadata, env.Payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = payload
+		evt, err := decodeEvent(env.Codec, proto, env.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return ec.startSaga(ctx, def, env, evt)
+	}
 
-func (e PaymentFailed) isEvent() {}
+	var err error
+	for i := 0; i < maxEventAttempts; i++ {
+		var saga *Saga
+		saga, err = ec.applyMessage(ctx, env)
+		if !errors.Is(err, ErrConcurrentModification) {
+			return saga, err
+		}
+	}
+	return nil, err
+}
 
-func (ec *ExecutionCoordinator) onPaymentFailed(ctx context.Context, event PaymentFailed) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+func (ec *ExecutionCoordinator) applyMessage(ctx context.Context, env Envelope) (*Saga, error) {
+	saga, err := ec.findSaga(ctx, env.CorrelationID)
+	if err != nil {
+		return nil, err
+	}
+	if ec.processedInTx {
+		saga.processed = env.MessageID
+	}
+	def, err := ec.definition(saga.Name, saga.Version)
+	if err != nil {
+		return nil, err
+	}
+	switch env.Type {
+	case typeName(StepTimedOut{}):
+		var evt StepTimedOut
+		if err := unmarshal(env.Codec, env.Payload, &evt); err != nil {
+			return nil, err
+		}
+		return ec.handleTimeout(ctx, &saga, env, evt)
+	case typeName(CompensationResolved{}):
+		var evt CompensationResolved
+		if err := unmarshal(env.Codec, env.Payload, &evt); err != nil {
+			return nil, err
+		}
+		return ec.handleResolved(ctx, &saga, env, evt)
+	}
+	proto, ok := def.lookupEvent(env.Type)
+	if !ok {
+		return nil, fmt.Errorf("saga %q does not handle event %s", def.Name, env.Type)
+	}
+	if env.Payload, err = def.upgrade(&env.Metadata, env.Payload); err != nil {
+		return nil, err
+	}
+	evt, err := decodeEvent(env.Codec, proto, env.Payload)
 	if err != nil {
 		return nil, err
 	}
-	return ec.handleEvent(ctx, &saga, "create-payment", "pending", "failed", event)
+	return ec.handleEvent(ctx, def, &saga, env, evt)
 }
 
-type PaymentRefunded struct {
-	ID string
+// findSaga loads the saga and rejects it if it was persisted with an unknown
+// status.
+func (ec *ExecutionCoordinator) findSaga(ctx context.Context, id string) (Saga, error) {
+	saga, err := ec.repo.FindSaga(ctx, id)
+	if err != nil {
+		return Saga{}, err
+	}
+	if err := saga.Validate(); err != nil {
+		return Saga{}, err
+	}
+	if err := ec.migrate(&saga); err != nil {
+		return Saga{}, err
+	}
+	if err := ec.upgrade(&saga); err != nil {
+		return Saga{}, err
+	}
+	return saga, nil
 }
 
-func (e PaymentRefunded) isEvent() {}
-
-func (ec *ExecutionCoordinator) onPaymentRefunded(ctx context.Context, event PaymentRefunded) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+// upgrade upgrades the payloads of the saga stored in an earlier version of
+// the schema of its definition. The upgraded saga is saved with its next
+// update.
+func (ec *ExecutionCoordinator) upgrade(saga *Saga) error {
+	def, err := ec.definition(saga.Name, saga.Version)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	upgraded, err := def.upgradeSaga(saga)
+	if err != nil {
+		return fmt.Errorf("upgrade saga %q: %w", saga.ID, err)
+	}
+	if !upgraded {
+		return nil
+	}
+	rec, err := stateRecord(saga)
+	if err != nil {
+		return err
+	}
+	saga.record(rec)
+	return nil
+}
+
+// migrate upgrades the saga with the migrators of the later versions of its
+// definition, one version at a time, until the next version has no migrator.
+// The upgraded saga is saved with its next update.
+func (ec *ExecutionCoordinator) migrate(saga *Saga) error {
+	for {
+		next, ok := ec.definitions[saga.Name][saga.Version+1]
+		if !ok || next.Migrate == nil {
+			return nil
+		}
+		if err := next.Migrate(saga); err != nil {
+			return fmt.Errorf("migrate saga %q to version %d: %w", saga.ID, next.Version, err)
+		}
+		saga.Version = next.Version
+		if err := next.conforms(saga); err != nil {
+			return err
+		}
+		rec, err := stateRecord(saga)
+		if err != nil {
+			return err
+		}
+		saga.record(rec)
 	}
-	return ec.handleEvent(ctx, &saga, "create-payment", "success", "compensated", event)
 }
 
-type BookingConfirmed struct {
-	ID string
+// startSaga creates a new saga, identified by the correlation id of the event
+// that started it.
+func (ec *ExecutionCoordinator) startSaga(ctx context.Context, def *SagaDefinition, env Envelope, evt event) (*Saga, error) {
+	saga := def.NewSaga(env.CorrelationID)
+	// The event that starts the saga is its input.
+	saga.Payload = cloneBytes(env.Payload)
+	saga.PayloadCodec = env.Codec
+	saga.PayloadSchemaVersion = env.SchemaVersion
+	if ec.processedInTx {
+		saga.processed = env.MessageID
+	}
+	rec, err := stateRecord(saga)
+	if err != nil {
+		return nil, err
+	}
+	saga.record(rec)
+	if _, err := applyTransition(def, saga, env, evt); err != nil {
+		return nil, err
+	}
+	createdSaga, err := ec.repo.CreateSaga(ctx, saga)
+	if errors.Is(err, ErrAlreadyExists) {
+		return ec.findStarted(ctx, def, env)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &createdSaga, nil
 }
 
-func (e BookingConfirmed) isEvent() {}
-
-func (ec *ExecutionCoordinator) onBookingConfirmed(ctx context.Context, event BookingConfirmed) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+// findStarted returns ErrDuplicateMessage if the saga was started by the
+// message, e.g. when the message is delivered again before it was marked as
+// processed.
+func (ec *ExecutionCoordinator) findStarted(ctx context.Context, def *SagaDefinition, env Envelope) (*Saga, error) {
+	saga, err := ec.findSaga(ctx, env.CorrelationID)
 	if err != nil {
 		return nil, err
 	}
-	return ec.handleEvent(ctx, &saga, "confirm-booking", "pending", "success", event)
+	step, err := saga.GetStep(def.Steps[0].Name)
+	if err != nil {
+		return nil, err
+	}
+	if step.ResponseMetadata.MessageID != env.MessageID {
+		return nil, ErrAlreadyExists
+	}
+	return nil, ErrDuplicateMessage
 }
 
-type BookingRejected struct {
-	ID string
+func (ec *ExecutionCoordinator) handleEvent(ctx context.Context, def *SagaDefinition, saga *Saga, env Envelope, evt event) (*Saga, error) {
+	changed, err := applyTransition(def, saga, env, evt)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return saga, nil
+	}
+	updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+	return &updatedSaga, nil
 }
 
-func (e BookingRejected) isEvent() {}
+// applyTransition moves the step targeted by the event to its next status. It
+// returns false if the step is already in that status, or if the step fails
+// after the saga has ended, and ErrDuplicateMessage if the message has already
+// been applied to the step.
+func applyTransition(def *SagaDefinition, saga *Saga, env Envelope, evt event) (bool, error) {
+	stepDef, t, ok := def.Transition(evt)
+	if !ok {
+		return false, fmt.Errorf("saga %q does not handle event %s", def.Name, eventType(evt))
+	}
 
-func (ec *ExecutionCoordinator) onBookingRejected(ctx context.Context, event BookingRejected) (*Saga, error) {
-	saga, err := ec.repo.FindSaga(ctx, event.ID)
+	step, err := saga.GetStep(stepDef.Name)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return ec.handleEvent(ctx, &saga, "confirm-booking", "success", "failed", event)
+	if step.ResponseMetadata.MessageID == env.MessageID {
+		return false, ErrDuplicateMessage
+	}
+	if step.Status == t.To {
+		return false, nil
+	}
+	if step.Status != t.From {
+		return false, errors.New("invalid status transition")
+	}
+	// An ended saga is no longer compensated, so a late failure of a step
+	// that has succeeded is acknowledged without being applied.
+	if saga.Status.Terminal() && t.To == StepStatusFailed {
+		log.Printf("ignored event %s of step %s of saga %s, which is %s\n", eventType(evt), step.Name, saga.ID, saga.Status)
+		return false, nil
+	}
+	if stepDef.Kind == StepRetriable && t.To == StepStatusFailed {
+		return true, retryForward(def, saga, stepDef, step, env, evt)
+	}
+	if err := applyEvent(saga, step, t.To, env, evt); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (ec *ExecutionCoordinator) handleEvent(ctx context.Context, saga *Saga, targetStep, fromStatus, toStatus string, evt event) (*Saga, error) {
-	step, err := saga.GetStep(targetStep)
+// handleTimeout fails the step if it is still pending. Steps that have
+// received their event in the meantime are left unchanged. Retriable steps
+// are sent again instead.
+func (ec *ExecutionCoordinator) handleTimeout(ctx context.Context, saga *Saga, env Envelope, evt StepTimedOut) (*Saga, error) {
+	def, err := ec.definition(saga.Name, saga.Version)
 	if err != nil {
 		return nil, err
 	}
-	if step.Status == toStatus {
-		return saga, nil
-	}
-	if step.Status != fromStatus {
-		return nil, errors.New("invalid status transition")
+	stepDef, err := def.GetStep(evt.Step)
+	if err != nil {
+		return nil, err
 	}
-	b, err := json.Marshal(evt)
+	step, err := saga.GetStep(evt.Step)
 	if err != nil {
 		return nil, err
 	}
-	step.Status = toStatus
-	step.ResponsePayload = b
-	if err := saga.UpdateStep(step); err != nil {
+	if step.Status != StepStatusPending || step.Deadline == nil {
+		return saga, nil
+	}
+	if stepDef.Kind == StepRetriable {
+		err = retryForward(def, saga, stepDef, step, env, evt)
+	} else {
+		err = applyEvent(saga, step, StepStatusFailed, env, evt)
+	}
+	if err != nil {
 		return nil, err
 	}
 	updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
@@ -249,33 +733,192 @@ func (ec *ExecutionCoordinator) handleEvent(ctx context.Context, saga *Saga, tar
 	return &updatedSaga, nil
 }
 
-func (ec *ExecutionCoordinator) handleCommand(ctx context.Context, saga Saga, targetStep string, fromStatus, toStatus string, cmd command) (*Step, error) {
-	step, err := saga.GetStep(targetStep)
+// applyEvent moves the step to the given status with the response of the
+// event, and records the change.
+func applyEvent(saga *Saga, step Step, to StepStatus, env Envelope, evt event) error {
+	step.Status = to
+	step.ResponsePayload = cloneBytes(env.Payload)
+	step.ResponseMetadata = env.Metadata.clone()
+	step.Deadline = nil
+	step.Attempts = 0
+	step.NextRetry = nil
+	step.LastError = ""
+	if err := saga.UpdateStep(step); err != nil {
+		return err
+	}
+	saga.record(LogRecord{
+		Type:       LogRecordEvent,
+		Step:       step.Name,
+		Name:       typeName(evt),
+		StepStatus: step.Status,
+		Metadata:   env.Metadata.clone(),
+		Payload:    env.Payload,
+	})
+	// The saga is no longer stuck once the step has been undone.
+	if saga.Status == SagaStatusStuck && to == StepStatusCompensated {
+		if err := saga.transition(SagaStatusCompensating); err != nil {
+			return err
+		}
+	}
+	return saga.syncStatus()
+}
+
+// handleCommand builds the command that moves the step from fromStatus to
+// toStatus, records it on the step and publishes it. The saga is updated in
+// place with the latest revision. Commands that move the step from
+// pending start the timeout of the step when they are first sent.
+//
+// A command that has been sent is only sent again when its retry is due, with
+// the same envelope, so that it can be deduplicated by the participant.
+// Without an outbox, commands are published after the saga is saved, and a
+// crash between saving and publishing leaves the command unsent until the
+// saga is resumed. Commands that fail to be published are retried according
+// to the retry policy of the step.
+func (ec *ExecutionCoordinator) handleCommand(ctx context.Context, saga *Saga, stepDef *StepDefinition, fromStatus, toStatus StepStatus) (*Step, error) {
+	step, err := saga.GetStep(stepDef.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	// The first step is triggered externally, so it
-	// must always be successful.
 	switch step.Status {
 	case toStatus:
 		return &step, nil
 	case fromStatus:
-		b, err := json.Marshal(cmd)
-		if err != nil {
-			return nil, err
+		resend := step.sent(stepDef.command(fromStatus))
+		if resend && step.NextRetry == nil {
+			return &step, nil
+		}
+		env := Envelope{
+			Metadata: step.RequestMetadata.clone(),
+			Payload:  step.RequestPayload,
+		}
+		if !resend {
+			cmd, err := stepDef.buildCommand(*saga, fromStatus)
+			if err != nil {
+				return nil, err
+			}
+			def, err := ec.definition(saga.Name, saga.Version)
+			if err != nil {
+				return nil, err
+			}
+			// The command is caused by the last event applied to the saga.
+			env, err = newEnvelope(def.codec(), def.schemaVersion(), saga.ID, saga.lastMessage().MessageID, cmd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		step.RequestPayload = env.Payload
+		step.RequestMetadata = env.Metadata.clone()
+		step.NextRetry = nil
+		if fromStatus == StepStatusPending && stepDef.Timeout > 0 && step.Deadline == nil {
+			deadline := time.Now().Add(stepDef.Timeout)
+			step.Deadline = &deadline
 		}
-		step.Status = fromStatus
-		step.RequestPayload = b
 		if err := saga.UpdateStep(step); err != nil {
 			return nil, err
 		}
-		_, err = ec.repo.UpdateSaga(ctx, &saga)
+		saga.record(LogRecord{
+			Type:     LogRecordCommand,
+			Step:     step.Name,
+			Name:     env.Type,
+			Metadata: env.Metadata,
+			Deadline: step.Deadline,
+			Payload:  env.Payload,
+		})
+		envelope := CommandEnvelope{
+			Envelope:     env,
+			Step:         step.Name,
+			Compensation: fromStatus == StepStatusSuccess,
+		}
+		if ec.outbox {
+			saga.enqueue(envelope)
+		}
+		updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
 		if err != nil {
 			return nil, err
 		}
+		*saga = updatedSaga
+
+		if !ec.outbox {
+			if err := ec.publisher.Publish(ctx, envelope); err != nil {
+				return ec.dispatchFailed(ctx, saga, stepDef, fromStatus, err)
+			}
+		}
 		return &step, nil
 	default:
 		return nil, errors.New("invalid status")
 	}
 }
+
+// dispatchFailed records the failed attempt to send the command of the step,
+// and schedules the next attempt according to the retry policy of the step.
+// A pending step that runs out of attempts fails, so that the saga is
+// compensated.
+//
+// Compensation commands are retried indefinitely with the compensation retry
+// policy, and the saga is marked as stuck once they have failed MaxAttempts
+// times. The commands of retriable steps are also retried indefinitely, with
+// the default retry policy if the step has none. The command of any other step
+// without a retry policy is sent again by the next flow of the saga.
+func (ec *ExecutionCoordinator) dispatchFailed(ctx context.Context, saga *Saga, stepDef *StepDefinition, fromStatus StepStatus, cause error) (*Step, error) {
+	compensating := fromStatus == StepStatusSuccess
+	policy := stepDef.Retry
+	switch {
+	case compensating:
+		policy = &ec.compensationRetry
+	case stepDef.Kind == StepRetriable:
+		p := stepDef.retryPolicy()
+		policy = &p
+	}
+	step, err := saga.GetStep(stepDef.Name)
+	if err != nil {
+		return nil, err
+	}
+	step.Attempts++
+	step.LastError = cause.Error()
+	step.NextRetry = nil
+	switch {
+	case policy == nil:
+		// The command is already stored with the step, so it is only sent
+		// again if a retry is due.
+		nextRetry := time.Now()
+		step.NextRetry = &nextRetry
+	case compensating || stepDef.Kind == StepRetriable || policy.retry(step.Attempts, cause):
+		nextRetry := time.Now().Add(policy.Backoff(step.Attempts))
+		step.NextRetry = &nextRetry
+	default:
+		step.Status = StepStatusFailed
+		step.Deadline = nil
+	}
+	if err := saga.UpdateStep(step); err != nil {
+		return nil, err
+	}
+	saga.record(LogRecord{
+		Type:       LogRecordRetry,
+		Step:       step.Name,
+		StepStatus: step.Status,
+		Attempts:   step.Attempts,
+		NextRetry:  step.NextRetry,
+		Error:      step.LastError,
+	})
+	if err := saga.syncStatus(); err != nil {
+		return nil, err
+	}
+	if compensating && step.Attempts >= policy.MaxAttempts && saga.Status == SagaStatusCompensating {
+		log.Printf("saga %s is stuck compensating step %s: %s\n", saga.ID, step.Name, cause)
+		if err := saga.transition(SagaStatusStuck); err != nil {
+			return nil, err
+		}
+	}
+	updatedSaga, err := ec.repo.UpdateSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+	*saga = updatedSaga
+
+	if step.Status == StepStatusFailed {
+		log.Printf("failed to send command of step %s of saga %s: %s\n", step.Name, saga.ID, cause)
+		return &step, nil
+	}
+	return nil, cause
+}
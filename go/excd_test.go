@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,12 +11,12 @@ import (
 
 func TestBookingFlow(t *testing.T) {
 	rep := NewInMemoryStore()
-	sec := NewExecutionCoordinator(rep)
+	sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
 	ctx := context.Background()
 
 	t.Run("step create booking", func(t *testing.T) {
 		// Given that the booking is created.
-		sg, err := sec.onBookingCreated(ctx, BookingCreated{
+		sg, err := sec.HandleEvent(ctx, BookingCreated{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -29,21 +30,21 @@ func TestBookingFlow(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("success", step.Status)
+		assert.Equal(StepStatusSuccess, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
 		// And the saga status should be `pending`.
-		assert.Equal("pending", saga.CheckStatus())
+		assert.Equal(SagaStatusPending, saga.CheckStatus())
 
 		// And the next step should be executed.
-		err = sec.BookingFlow(ctx, saga)
+		err = sec.ForwardFlow(ctx, saga)
 		assert.Nil(err)
 	})
 
 	t.Run("step create payment", func(t *testing.T) {
-		sg, err := sec.onPaymentCreated(ctx, PaymentCreated{
+		sg, err := sec.HandleEvent(ctx, PaymentCreated{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -56,21 +57,21 @@ func TestBookingFlow(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("success", step.Status)
+		assert.Equal(StepStatusSuccess, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
 		// And the saga status should be `pending`.
-		assert.Equal("pending", saga.CheckStatus())
+		assert.Equal(SagaStatusPending, saga.CheckStatus())
 
 		// And the next step should be executed.
-		err = sec.BookingFlow(ctx, saga)
+		err = sec.ForwardFlow(ctx, saga)
 		assert.Nil(err)
 	})
 
 	t.Run("step confirm booking", func(t *testing.T) {
-		sg, err := sec.onBookingConfirmed(ctx, BookingConfirmed{
+		sg, err := sec.HandleEvent(ctx, BookingConfirmed{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -83,16 +84,16 @@ func TestBookingFlow(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("success", step.Status)
+		assert.Equal(StepStatusSuccess, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
-		// And the saga status should be `done`.
-		assert.Equal("done", saga.CheckStatus())
+		// And the saga status should be `completed`.
+		assert.Equal(SagaStatusCompleted, saga.CheckStatus())
 
 		// And the next step should be executed.
-		err = sec.BookingFlow(ctx, saga)
+		err = sec.ForwardFlow(ctx, saga)
 		assert.Nil(err)
 	})
 }
@@ -103,22 +104,24 @@ func TestCompensation(t *testing.T) {
 		ID:      "1",
 		Name:    "booking-saga",
 		Version: 1,
+		Status:  SagaStatusPending,
+		Payload: []byte(`{"ID":"1","Amount":100}`),
 		Steps: []Step{
-			{Name: "create-booking", Status: "success"},
-			{Name: "create-payment", Status: "success"},
-			{Name: "confirm-booking", Status: "success"},
+			{Name: "create-booking", Status: StepStatusSuccess, ResponsePayload: []byte(`{"ID":"1","Amount":100}`)},
+			{Name: "create-payment", Status: StepStatusSuccess},
+			{Name: "confirm-booking", Status: StepStatusPending, RequestPayload: []byte("{}")},
 		},
 	}
 	ctx := context.Background()
 
-	_, err := rep.UpdateSaga(ctx, saga)
+	_, err := rep.CreateSaga(ctx, saga)
 	require.Nil(t, err)
 
-	sec := NewExecutionCoordinator(rep)
+	sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
 
 	t.Run("step reject booking", func(t *testing.T) {
 		// Given that the booking is rejected.
-		sg, err := sec.onBookingRejected(ctx, BookingRejected{
+		sg, err := sec.HandleEvent(ctx, BookingRejected{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -132,13 +135,13 @@ func TestCompensation(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("failed", step.Status)
+		assert.Equal(StepStatusFailed, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
 		// And the saga status should be `pending`.
-		assert.Equal("compensating", saga.CheckStatus())
+		assert.Equal(SagaStatusCompensating, saga.CheckStatus())
 
 		// And the next step should be executed.
 		err = sec.CompensationFlow(ctx, saga)
@@ -146,7 +149,7 @@ func TestCompensation(t *testing.T) {
 	})
 
 	t.Run("step refund payment", func(t *testing.T) {
-		sg, err := sec.onPaymentRefunded(ctx, PaymentRefunded{
+		sg, err := sec.HandleEvent(ctx, PaymentRefunded{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -159,13 +162,13 @@ func TestCompensation(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("compensated", step.Status)
+		assert.Equal(StepStatusCompensated, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
 		// And the saga status should be `pending`.
-		assert.Equal("compensating", saga.CheckStatus())
+		assert.Equal(SagaStatusCompensating, saga.CheckStatus())
 
 		// And the next step should be executed.
 		err = sec.CompensationFlow(ctx, saga)
@@ -174,7 +177,7 @@ func TestCompensation(t *testing.T) {
 
 	t.Run("step booking cancelled", func(t *testing.T) {
 		// Given that the Saga Execution Coordinator receives the booking cancelled event.
-		sg, err := sec.onBookingCancelled(ctx, BookingCancelled{
+		sg, err := sec.HandleEvent(ctx, BookingCancelled{
 			ID: "1",
 		})
 		assert := assert.New(t)
@@ -187,16 +190,199 @@ func TestCompensation(t *testing.T) {
 		assert.Nil(err)
 
 		// Then the status should be `success`.
-		assert.Equal("compensated", step.Status)
+		assert.Equal(StepStatusCompensated, step.Status)
 
 		// And the response payload should not be empty.
 		assert.NotNil(step.ResponsePayload)
 
-		// And the saga status should be `done`.
-		assert.Equal("done", saga.CheckStatus())
+		// And the saga status should be `compensated`.
+		assert.Equal(SagaStatusCompensated, saga.CheckStatus())
 
 		// And the next step should be executed.
 		err = sec.CompensationFlow(ctx, saga)
 		assert.Nil(err)
 	})
 }
+
+func TestStartSaga(t *testing.T) {
+	rep := NewInMemoryStore()
+	sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
+	ctx := context.Background()
+
+	t.Run("when sagas are started", func(t *testing.T) {
+		assert := assert.New(t)
+
+		first, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		assert.Nil(err)
+
+		second, err := sec.HandleEvent(ctx, BookingCreated{ID: "2"})
+		assert.Nil(err)
+
+		// Then each saga is stored separately.
+		saga, err := rep.FindSaga(ctx, first.ID)
+		assert.Nil(err)
+		assert.Equal("1", saga.ID)
+
+		saga, err = rep.FindSaga(ctx, second.ID)
+		assert.Nil(err)
+		assert.Equal("2", saga.ID)
+	})
+
+	t.Run("when saga is started twice", func(t *testing.T) {
+		_, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		assert.ErrorIs(t, err, ErrAlreadyExists)
+	})
+}
+
+func TestUnknownStatus(t *testing.T) {
+	rep := NewInMemoryStore()
+	ctx := context.Background()
+
+	_, err := rep.CreateSaga(ctx, &Saga{
+		ID:      "1",
+		Name:    "booking-saga",
+		Version: 1,
+		Status:  SagaStatusPending,
+		Steps: []Step{
+			{Name: "create-booking", Status: StepStatusSuccess},
+			{Name: "create-payment", Status: "sucess"},
+			{Name: "confirm-booking", Status: StepStatusPending},
+		},
+	})
+	require.Nil(t, err)
+
+	sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
+	_, err = sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+	assert.NotNil(t, err)
+}
+
+// conflictingStore fails the next n updates as if the saga was modified
+// concurrently.
+type conflictingStore struct {
+	*InMemoryStore
+	conflicts int
+}
+
+func (r *conflictingStore) UpdateSaga(ctx context.Context, saga *Saga) (Saga, error) {
+	if r.conflicts > 0 {
+		r.conflicts--
+		return Saga{}, ErrConcurrentModification
+	}
+	return r.InMemoryStore.UpdateSaga(ctx, saga)
+}
+
+func TestConcurrentModification(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(t *testing.T, conflicts int) *conflictingStore {
+		rep := &conflictingStore{InMemoryStore: NewInMemoryStore()}
+		saga := NewBookingSagaDefinition().NewSaga("1")
+		saga.Steps[0].Status = StepStatusSuccess
+		_, err := rep.CreateSaga(ctx, saga)
+		require.Nil(t, err)
+
+		rep.conflicts = conflicts
+		return rep
+	}
+
+	t.Run("when the conflict is transient", func(t *testing.T) {
+		assert := assert.New(t)
+		rep := newStore(t, maxEventAttempts-1)
+		sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		saga, err := sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+		assert.Nil(err)
+
+		step, err := saga.GetStep("create-payment")
+		assert.Nil(err)
+		assert.Equal(StepStatusSuccess, step.Status)
+	})
+
+	t.Run("when the conflict persists", func(t *testing.T) {
+		rep := newStore(t, maxEventAttempts)
+		sec := NewExecutionCoordinator(rep, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		_, err := sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+		assert.ErrorIs(t, err, ErrConcurrentModification)
+	})
+}
+
+func TestCommandPublisher(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when saga completes", func(t *testing.T) {
+		assert := assert.New(t)
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(NewInMemoryStore(), pub, NewBookingSagaDefinition())
+
+		runBookingSaga(t, sec, "1")
+
+		commands := pub.Commands()
+		assert.Len(commands, 2)
+		assert.Equal("1", commands[0].CorrelationID)
+		assert.Equal("create-payment", commands[0].Step)
+		assert.Equal("CreatePaymentCommand", commands[0].Type)
+		assert.JSONEq(`{"BookingID":"1","Amount":0}`, string(commands[0].Payload))
+		assert.NotEmpty(commands[0].MessageID)
+		assert.Equal("confirm-booking", commands[1].Step)
+		assert.Equal("ConfirmBookingCommand", commands[1].Type)
+	})
+
+	t.Run("when saga is compensated", func(t *testing.T) {
+		assert := assert.New(t)
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(NewInMemoryStore(), pub, NewBookingSagaDefinition())
+
+		for _, evt := range []event{
+			BookingCreated{ID: "1"},
+			PaymentCreated{ID: "1"},
+			BookingRejected{ID: "1"},
+			PaymentRefunded{ID: "1"},
+			BookingCancelled{ID: "1"},
+		} {
+			saga, err := sec.HandleEvent(ctx, evt)
+			require.Nil(t, err)
+			require.Nil(t, sec.Continue(ctx, *saga))
+		}
+
+		var types []string
+		for _, cmd := range pub.Commands() {
+			types = append(types, cmd.Type)
+		}
+		assert.Equal([]string{
+			"CreatePaymentCommand",
+			"ConfirmBookingCommand",
+			"RefundPaymentCommand",
+			"CancelBookingCommand",
+		}, types)
+	})
+
+	t.Run("when the flow is run again", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+
+		handle(t, sec, BookingCreated{ID: "1"})
+		saga, err := store.FindSaga(ctx, "1")
+		require.Nil(t, err)
+		require.Nil(t, sec.Continue(ctx, saga))
+
+		// Then the command that was sent is not sent again, and the saga is
+		// not updated.
+		assert.Len(pub.Commands(), 1)
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(saga.Revision, found.Revision)
+	})
+
+	t.Run("when publish fails", func(t *testing.T) {
+		pub := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+			return errors.New("broker unavailable")
+		})
+		sec := NewExecutionCoordinator(NewInMemoryStore(), pub, NewBookingSagaDefinition())
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		assert.NotNil(t, sec.ForwardFlow(ctx, *saga))
+	})
+}
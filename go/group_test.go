@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The trip saga reserves a hotel, a flight and a car at the same time.
+type (
+	TripCreated     struct{ ID string }
+	TripConfirmed   struct{ ID string }
+	HotelReserved   struct{ ID string }
+	HotelFailed     struct{ ID string }
+	HotelCancelled  struct{ ID string }
+	FlightReserved  struct{ ID string }
+	FlightFailed    struct{ ID string }
+	FlightCancelled struct{ ID string }
+	CarReserved     struct{ ID string }
+	CarFailed       struct{ ID string }
+	CarCancelled    struct{ ID string }
+
+	ReserveCommand struct{ Resource string }
+	CancelCommand  struct{ Resource string }
+	ConfirmCommand struct{}
+)
+
+func (TripCreated) isEvent()     {}
+func (TripConfirmed) isEvent()   {}
+func (HotelReserved) isEvent()   {}
+func (HotelFailed) isEvent()     {}
+func (HotelCancelled) isEvent()  {}
+func (FlightReserved) isEvent()  {}
+func (FlightFailed) isEvent()    {}
+func (FlightCancelled) isEvent() {}
+func (CarReserved) isEvent()     {}
+func (CarFailed) isEvent()       {}
+func (CarCancelled) isEvent()    {}
+
+func (e TripCreated) sagaID() string     { return e.ID }
+func (e TripConfirmed) sagaID() string   { return e.ID }
+func (e HotelReserved) sagaID() string   { return e.ID }
+func (e HotelFailed) sagaID() string     { return e.ID }
+func (e HotelCancelled) sagaID() string  { return e.ID }
+func (e FlightReserved) sagaID() string  { return e.ID }
+func (e FlightFailed) sagaID() string    { return e.ID }
+func (e FlightCancelled) sagaID() string { return e.ID }
+func (e CarReserved) sagaID() string     { return e.ID }
+func (e CarFailed) sagaID() string       { return e.ID }
+func (e CarCancelled) sagaID() string    { return e.ID }
+
+func (ReserveCommand) isCommand() {}
+func (CancelCommand) isCommand()  {}
+func (ConfirmCommand) isCommand() {}
+
+func newTripSagaDefinition(required int) *SagaDefinition {
+	return NewSagaDefinition("trip-saga").
+		AddStep(NewStepDefinition("create-trip").
+			OnSuccess(TripCreated{})).
+		AddGroup(NewStepGroup("reserve").
+			WithQuorum(required).
+			AddStep(NewStepDefinition("reserve-hotel").
+				Invoke(ReserveCommand{Resource: "hotel"}).
+				WithCompensation(CancelCommand{Resource: "hotel"}).
+				OnSuccess(HotelReserved{}).
+				OnFailure(HotelFailed{}).
+				OnCompensated(HotelCancelled{})).
+			AddStep(NewStepDefinition("reserve-flight").
+				Invoke(ReserveCommand{Resource: "flight"}).
+				WithCompensation(CancelCommand{Resource: "flight"}).
+				OnSuccess(FlightReserved{}).
+				OnFailure(FlightFailed{}).
+				OnCompensated(FlightCancelled{})).
+			AddStep(NewStepDefinition("reserve-car").
+				Invoke(ReserveCommand{Resource: "car"}).
+				WithCompensation(CancelCommand{Resource: "car"}).
+				OnSuccess(CarReserved{}).
+				OnFailure(CarFailed{}).
+				OnCompensated(CarCancelled{}))).
+		AddStep(NewStepDefinition("confirm-trip").
+			Invoke(ConfirmCommand{}).
+			OnSuccess(TripConfirmed{}))
+}
+
+func TestStepGroup(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when all steps succeed", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newTripSagaDefinition(0))
+
+			// Then the commands of the group are sent together.
+			handle(t, sec, TripCreated{ID: "1"})
+			assert.Equal([]string{
+				"ReserveCommand reserve-hotel",
+				"ReserveCommand reserve-flight",
+				"ReserveCommand reserve-car",
+			}, steps(pub))
+
+			// And the saga waits for every step of the group, without
+			// sending their commands again.
+			handle(t, sec, HotelReserved{ID: "1"}, FlightReserved{ID: "1"})
+			assert.Len(pub.Commands(), 3)
+
+			handle(t, sec, CarReserved{ID: "1"})
+			assert.Equal("ConfirmCommand confirm-trip", steps(pub)[3])
+
+			handle(t, sec, TripConfirmed{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+			step, err := saga.GetStep("reserve-car")
+			assert.Nil(err)
+			assert.Equal("reserve", step.Group)
+		})
+
+		t.Run("when a step fails", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newTripSagaDefinition(0))
+
+			handle(t, sec, TripCreated{ID: "1"}, HotelReserved{ID: "1"}, FlightFailed{ID: "1"})
+
+			// Then the compensation waits for the step that has not
+			// responded yet.
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensating, saga.Status)
+			assert.Len(pub.Commands(), 3)
+
+			// And only the steps that succeeded are compensated.
+			handle(t, sec, CarReserved{ID: "1"})
+			assert.Equal("CancelCommand reserve-car", steps(pub)[3])
+			handle(t, sec, CarCancelled{ID: "1"})
+			assert.Equal("CancelCommand reserve-hotel", steps(pub)[4])
+			handle(t, sec, HotelCancelled{ID: "1"})
+			assert.Len(pub.Commands(), 5)
+
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+		})
+
+		t.Run("when a quorum of steps succeed", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newTripSagaDefinition(2))
+
+			// Then the saga proceeds without waiting for the last step.
+			handle(t, sec, TripCreated{ID: "1"}, HotelReserved{ID: "1"}, FlightReserved{ID: "1"})
+			assert.Equal("ConfirmCommand confirm-trip", steps(pub)[3])
+
+			// And the failure of the last step is tolerated.
+			handle(t, sec, CarFailed{ID: "1"}, TripConfirmed{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+		})
+
+		t.Run("when the quorum cannot be reached", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newTripSagaDefinition(2))
+
+			handle(t, sec, TripCreated{ID: "1"}, HotelReserved{ID: "1"}, FlightFailed{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusPending, saga.Status)
+
+			handle(t, sec, CarFailed{ID: "1"})
+			assert.Equal("CancelCommand reserve-hotel", steps(pub)[3])
+
+			handle(t, sec, HotelCancelled{ID: "1"})
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+		})
+	})
+}
+
+func TestStepGroup_Validate(t *testing.T) {
+	step := func(name string, evt event) *StepDefinition {
+		return NewStepDefinition(name).OnSuccess(evt)
+	}
+
+	t.Run("when the saga starts with a group", func(t *testing.T) {
+		def := NewSagaDefinition("trip-saga").
+			AddGroup(NewStepGroup("reserve").
+				AddStep(step("reserve-hotel", HotelReserved{})).
+				AddStep(step("reserve-flight", FlightReserved{})))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when the quorum is larger than the group", func(t *testing.T) {
+		def := NewSagaDefinition("trip-saga").
+			AddStep(step("create-trip", TripCreated{})).
+			AddGroup(NewStepGroup("reserve").
+				WithQuorum(3).
+				AddStep(step("reserve-hotel", HotelReserved{})).
+				AddStep(step("reserve-flight", FlightReserved{})))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when the group is duplicated", func(t *testing.T) {
+		def := NewSagaDefinition("trip-saga").
+			AddStep(step("create-trip", TripCreated{})).
+			AddGroup(NewStepGroup("reserve").AddStep(step("reserve-hotel", HotelReserved{}))).
+			AddStep(step("confirm-trip", TripConfirmed{})).
+			AddGroup(NewStepGroup("reserve").AddStep(step("reserve-car", CarReserved{})))
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when a step is added between the steps of a group", func(t *testing.T) {
+		group := NewStepGroup("reserve").
+			AddStep(step("reserve-hotel", HotelReserved{})).
+			AddStep(step("reserve-flight", FlightReserved{}))
+		def := NewSagaDefinition("trip-saga").
+			AddStep(step("create-trip", TripCreated{}))
+		def.Steps = append(def.Steps, group.Steps[0], step("confirm-trip", TripConfirmed{}), group.Steps[1])
+		group.Steps[0].group = group
+		group.Steps[1].group = group
+
+		assert.NotNil(t, def.Validate())
+	})
+
+	t.Run("when creating a saga", func(t *testing.T) {
+		assert := assert.New(t)
+		saga := newTripSagaDefinition(2).NewSaga("1")
+
+		step, err := saga.GetStep("reserve-flight")
+		assert.Nil(err)
+		assert.Equal("reserve", step.Group)
+		assert.Equal(2, step.Required)
+	})
+}
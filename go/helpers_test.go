@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStore is implemented by the repositories the coordinator is tested
+// against.
+type testStore interface {
+	repository
+	Outbox
+	Deadlines
+	Retries
+	DeadLetters
+	ActiveSagas
+	ProcessedMessages
+}
+
+// forEachStore runs the test against each repository. newStore returns an
+// empty repository of the implementation under test.
+func forEachStore(t *testing.T, test func(t *testing.T, newStore func(t *testing.T) testStore)) {
+	stores := map[string]func(t *testing.T) testStore{
+		"in memory": func(t *testing.T) testStore {
+			return NewInMemoryStore()
+		},
+		"sql": func(t *testing.T) testStore {
+			return newSQLStore(t)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore)
+		})
+	}
+}
+
+// handle applies the events in order, and continues the saga after each.
+func handle(t *testing.T, sec *ExecutionCoordinator, events ...event) {
+	t.Helper()
+
+	for _, evt := range events {
+		saga, err := sec.HandleEvent(context.Background(), evt)
+		require.Nil(t, err)
+		require.Nil(t, sec.Continue(context.Background(), *saga))
+	}
+}
+
+// steps returns the steps of the commands that have been published.
+func steps(pub *InMemoryPublisher) []string {
+	var steps []string
+	for _, cmd := range pub.Commands() {
+		steps = append(steps, cmd.Type+" "+cmd.Step)
+	}
+	return steps
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+)
+
+// IDGenerator generates the id of sagas that are created without one. Sagas
+// created with an id, such as the correlation id of the event that started
+// them, keep it.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+type IDGeneratorFunc func() (string, error)
+
+func (fn IDGeneratorFunc) NewID() (string, error) {
+	return fn()
+}
+
+// UUIDGenerator generates random UUIDv4 ids.
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) NewID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// ULIDGenerator generates lexicographically sortable ids.
+type ULIDGenerator struct{}
+
+func (ULIDGenerator) NewID() (string, error) {
+	id, err := ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
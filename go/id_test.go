@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUUIDGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := UUIDGenerator{}.NewID()
+	assert.Nil(err)
+
+	parsed, err := uuid.Parse(id)
+	assert.Nil(err)
+	assert.Equal(uuid.Version(4), parsed.Version())
+}
+
+func TestULIDGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := ULIDGenerator{}.NewID()
+	assert.Nil(err)
+
+	_, err = ulid.Parse(id)
+	assert.Nil(err)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type LogRecordType string
+
+const (
+	// LogRecordState records the full state of the saga, e.g. when it is
+	// created.
+	LogRecordState LogRecordType = "state"
+
+	// LogRecordCommand records a command emitted for a step.
+	LogRecordCommand LogRecordType = "command"
+
+	// LogRecordEvent records an event consumed by a step.
+	LogRecordEvent LogRecordType = "event"
+
+	// LogRecordStatus records a change of the saga status.
+	LogRecordStatus LogRecordType = "status"
+
+	// LogRecordRetry records a command that failed to be sent.
+	LogRecordRetry LogRecordType = "retry"
+
+	// LogRecordSkip records a step moved to another status without a command
+	// or an event, e.g. a step without compensation command.
+	LogRecordSkip LogRecordType = "skip"
+)
+
+// sagaStatusDone is the status of both completed and compensated sagas in logs
+// and snapshots written before they were told apart. Replaying a saga derives
+// the status from its steps.
+const sagaStatusDone SagaStatus = "done"
+
+// LogRecord is an immutable entry in the saga log. Replaying the records of a
+// saga in order rebuilds its state.
+type LogRecord struct {
+	SagaID string
+	// Sequence is the position of the record in the saga log, starting at 1.
+	Sequence uint
+	// Revision is the revision of the saga after the record is applied.
+	Revision   uint
+	Type       LogRecordType
+	Step       string
+	Name       string
+	StepStatus StepStatus
+	SagaStatus SagaStatus
+	Metadata   Metadata
+	// Deadline is the deadline of the step set by a command.
+	Deadline *time.Time
+	// Attempts and NextRetry are the retry state of the step after a command
+	// failed to be sent.
+	Attempts  int
+	NextRetry *time.Time
+	Error     string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// SagaLog is an append-only log of the changes made to sagas.
+type SagaLog interface {
+	// Append appends the records only if the last record of the saga is at
+	// the given revision, and returns ErrConcurrentModification otherwise.
+	Append(ctx context.Context, sagaID string, revision uint, records []LogRecord) error
+
+	// Read returns the records of the saga after the given revision.
+	Read(ctx context.Context, sagaID string, revision uint) ([]LogRecord, error)
+}
+
+// record appends a change to be written to the saga log on the next update.
+func (s *Saga) record(rec LogRecord) {
+	s.changes = append(s.changes, rec)
+}
+
+func stateRecord(saga *Saga) (LogRecord, error) {
+	cp := saga.clone()
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return LogRecord{}, err
+	}
+	return LogRecord{
+		Type:    LogRecordState,
+		Name:    saga.Name,
+		Payload: b,
+	}, nil
+}
+
+// ReplaySaga applies the records to the saga in order.
+func ReplaySaga(saga Saga, records []LogRecord) (Saga, error) {
+	saga = saga.clone()
+	for _, rec := range records {
+		switch rec.Type {
+		case LogRecordState:
+			var state Saga
+			if err := json.Unmarshal(rec.Payload, &state); err != nil {
+				return Saga{}, err
+			}
+			// The id may have been generated when the saga was created.
+			if rec.SagaID != "" {
+				state.ID = rec.SagaID
+			}
+			saga = state
+		case LogRecordCommand:
+			step, err := saga.GetStep(rec.Step)
+			if err != nil {
+				return Saga{}, err
+			}
+			step.RequestPayload = cloneBytes(rec.Payload)
+			step.RequestMetadata = rec.Metadata.clone()
+			step.Deadline = rec.Deadline
+			step.NextRetry = nil
+			if err := saga.UpdateStep(step); err != nil {
+				return Saga{}, err
+			}
+		case LogRecordEvent:
+			step, err := saga.GetStep(rec.Step)
+			if err != nil {
+				return Saga{}, err
+			}
+			step.Status = rec.StepStatus
+			step.ResponsePayload = cloneBytes(rec.Payload)
+			step.ResponseMetadata = rec.Metadata.clone()
+			step.Deadline = nil
+			step.Attempts = 0
+			step.NextRetry = nil
+			step.LastError = ""
+			if err := saga.UpdateStep(step); err != nil {
+				return Saga{}, err
+			}
+		case LogRecordRetry:
+			step, err := saga.GetStep(rec.Step)
+			if err != nil {
+				return Saga{}, err
+			}
+			step.Status = rec.StepStatus
+			step.Attempts = rec.Attempts
+			step.NextRetry = rec.NextRetry
+			step.LastError = rec.Error
+			if err := saga.UpdateStep(step); err != nil {
+				return Saga{}, err
+			}
+		case LogRecordSkip:
+			step, err := saga.GetStep(rec.Step)
+			if err != nil {
+				return Saga{}, err
+			}
+			step.Status = rec.StepStatus
+			if err := saga.UpdateStep(step); err != nil {
+				return Saga{}, err
+			}
+		case LogRecordStatus:
+			saga.Status = rec.SagaStatus
+		default:
+			return Saga{}, fmt.Errorf("unknown log record type: %q", rec.Type)
+		}
+		saga.Revision = rec.Revision
+	}
+	if saga.Status == sagaStatusDone {
+		saga.Status = saga.CheckStatus()
+	}
+	return saga, nil
+}
+
+// InMemoryLog is a SagaLog that is safe for concurrent use.
+type InMemoryLog struct {
+	mu      sync.RWMutex
+	records map[string][]LogRecord
+}
+
+func NewInMemoryLog() *InMemoryLog {
+	return &InMemoryLog{
+		records: make(map[string][]LogRecord),
+	}
+}
+
+func (l *InMemoryLog) Append(ctx context.Context, sagaID string, revision uint, records []LogRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	saved := l.records[sagaID]
+	var last uint
+	if len(saved) > 0 {
+		last = saved[len(saved)-1].Revision
+	}
+	if last != revision {
+		return ErrConcurrentModification
+	}
+	for _, rec := range records {
+		rec.SagaID = sagaID
+		rec.Sequence = uint(len(saved) + 1)
+		rec.Payload = cloneBytes(rec.Payload)
+		saved = append(saved, rec)
+	}
+	l.records[sagaID] = saved
+	return nil
+}
+
+func (l *InMemoryLog) Read(ctx context.Context, sagaID string, revision uint) ([]LogRecord, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var records []LogRecord
+	for _, rec := range l.records[sagaID] {
+		if rec.Revision > revision {
+			rec.Payload = cloneBytes(rec.Payload)
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// Snapshots stores the latest snapshot of each saga, so that only the log
+// records after it are replayed.
+type Snapshots interface {
+	// SaveSnapshot replaces the snapshot of the saga, unless the stored
+	// snapshot is more recent.
+	SaveSnapshot(ctx context.Context, saga Saga) error
+
+	// FindSnapshot returns the latest snapshot of the saga, or a saga at
+	// revision 0 if it has none.
+	FindSnapshot(ctx context.Context, id string) (Saga, error)
+}
+
+// InMemorySnapshots is a Snapshots that is safe for concurrent use.
+type InMemorySnapshots struct {
+	mu        sync.RWMutex
+	snapshots map[string]Saga
+}
+
+func NewInMemorySnapshots() *InMemorySnapshots {
+	return &InMemorySnapshots{
+		snapshots: make(map[string]Saga),
+	}
+}
+
+func (s *InMemorySnapshots) SaveSnapshot(ctx context.Context, saga Saga) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshots[saga.ID].Revision < saga.Revision {
+		s.snapshots[saga.ID] = saga.clone()
+	}
+	return nil
+}
+
+func (s *InMemorySnapshots) FindSnapshot(ctx context.Context, id string) (Saga, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := s.snapshots[id]
+	return snapshot.clone(), nil
+}
+
+// LogStore is a repository backed by the saga log. Updates append the changes
+// recorded on the saga, and sagas are rebuilt by replaying the log on top of
+// the latest snapshot.
+//
+// LogStore cannot query the sagas, so the coordinator features that need to,
+// like the outbox, timeouts, retries, dead letters and recovery, are not
+// available. SQLStore appends to the same log in the transaction of each
+// update, and supports them all.
+type LogStore struct {
+	log SagaLog
+	ids IDGenerator
+
+	// snapshotEvery is the number of revisions between snapshots. Snapshots
+	// are disabled when zero.
+	snapshotEvery uint
+	snapshots     Snapshots
+}
+
+func NewLogStore(log SagaLog) *LogStore {
+	return &LogStore{
+		log:       log,
+		ids:       UUIDGenerator{},
+		snapshots: NewInMemorySnapshots(),
+	}
+}
+
+// WithIDGenerator sets the generator for sagas created without an id.
+func (r *LogStore) WithIDGenerator(ids IDGenerator) *LogStore {
+	r.ids = ids
+	return r
+}
+
+// WithSnapshotEvery takes a snapshot of the saga every n revisions, so that
+// only the records after the snapshot are replayed.
+func (r *LogStore) WithSnapshotEvery(n uint) *LogStore {
+	r.snapshotEvery = n
+	return r
+}
+
+// WithSnapshots sets where the snapshots are stored. Snapshots are kept in
+// memory by default, and are lost when the process stops.
+func (r *LogStore) WithSnapshots(snapshots Snapshots) *LogStore {
+	r.snapshots = snapshots
+	return r
+}
+
+func (r *LogStore) FindSaga(ctx context.Context, id string) (Saga, error) {
+	snapshot, err := r.snapshots.FindSnapshot(ctx, id)
+	if err != nil {
+		return Saga{}, err
+	}
+
+	records, err := r.log.Read(ctx, id, snapshot.Revision)
+	if err != nil {
+		return Saga{}, err
+	}
+	if snapshot.Revision == 0 && len(records) == 0 {
+		return Saga{}, ErrNotFound
+	}
+	return ReplaySaga(snapshot, records)
+}
+
+// CreateSaga stores a new saga, generating an id if the saga has none.
+func (r *LogStore) CreateSaga(ctx context.Context, saga *Saga) (Saga, error) {
+	cp := *saga
+	cp.Revision = 0
+	if cp.ID == "" {
+		id, err := r.ids.NewID()
+		if err != nil {
+			return Saga{}, err
+		}
+		cp.ID = id
+	}
+	err := r.append(ctx, &cp)
+	if errors.Is(err, ErrConcurrentModification) {
+		return Saga{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return Saga{}, err
+	}
+	return cp.clone(), nil
+}
+
+// UpdateSaga appends the changes recorded on the saga, only if the saga is at
+// the latest revision in the log. It returns ErrNotFound if the saga has no
+// log.
+func (r *LogStore) UpdateSaga(ctx context.Context, saga *Saga) (Saga, error) {
+	// Appending at revision 0 would start the log of a saga that does not
+	// exist.
+	if saga.Revision == 0 {
+		if _, err := r.FindSaga(ctx, saga.ID); err != nil {
+			return Saga{}, err
+		}
+		return Saga{}, ErrConcurrentModification
+	}
+	cp := *saga
+	err := r.append(ctx, &cp)
+	if errors.Is(err, ErrConcurrentModification) {
+		if _, err := r.FindSaga(ctx, saga.ID); err != nil {
+			return Saga{}, err
+		}
+	}
+	if err != nil {
+		return Saga{}, err
+	}
+	return cp.clone(), nil
+}
+
+// append writes the changes recorded on the saga to the log, and increments
+// the revision of the saga. A snapshot that cannot be saved is logged, since
+// the saga is already in the log.
+func (r *LogStore) append(ctx context.Context, saga *Saga) error {
+	revision := saga.Revision
+	saga.Revision++
+	records, err := logRecords(saga)
+	if err != nil {
+		return err
+	}
+	if err := r.log.Append(ctx, saga.ID, revision, records); err != nil {
+		return err
+	}
+
+	if r.snapshotEvery > 0 && saga.Revision%r.snapshotEvery == 0 {
+		if err := r.snapshots.SaveSnapshot(ctx, saga.clone()); err != nil {
+			log.Printf("failed to save snapshot of saga %s: %s\n", saga.ID, err)
+		}
+	}
+	return nil
+}
+
+// logRecords returns the changes recorded on the saga, at the revision of the
+// saga. Sagas without recorded changes are written as a whole.
+func logRecords(saga *Saga) ([]LogRecord, error) {
+	records := append([]LogRecord(nil), saga.changes...)
+	if len(records) == 0 {
+		rec, err := stateRecord(saga)
+		if err != nil {
+			return nil, err
+		}
+		records = []LogRecord{rec}
+	}
+
+	now := time.Now()
+	for i := range records {
+		records[i].Revision = saga.Revision
+		records[i].CreatedAt = now
+	}
+	return records, nil
+}
+
+// typeName returns the name of the command or event type, without the pointer.
+func typeName(v interface{}) string {
+	typ := reflect.TypeOf(v)
+	if typ == nil {
+		return ""
+	}
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.Name()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runBookingSaga drives the booking saga to completion.
+func runBookingSaga(t *testing.T, sec *ExecutionCoordinator, id string) {
+	t.Helper()
+
+	ctx := context.Background()
+	events := []event{
+		BookingCreated{ID: id},
+		PaymentCreated{ID: id},
+		BookingConfirmed{ID: id},
+	}
+	for _, evt := range events {
+		saga, err := sec.HandleEvent(ctx, evt)
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when saga completes", func(t *testing.T) {
+		assert := assert.New(t)
+		log := NewInMemoryLog()
+		sec := NewExecutionCoordinator(NewLogStore(log), NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		runBookingSaga(t, sec, "1")
+
+		records, err := log.Read(ctx, "1", 0)
+		assert.Nil(err)
+
+		type entry struct {
+			Type LogRecordType
+			Step string
+			Name string
+		}
+		var got []entry
+		for _, rec := range records {
+			got = append(got, entry{rec.Type, rec.Step, rec.Name})
+		}
+		want := []entry{
+			{LogRecordState, "", "booking-saga"},
+			{LogRecordEvent, "create-booking", "BookingCreated"},
+			{LogRecordCommand, "create-payment", "CreatePaymentCommand"},
+			{LogRecordEvent, "create-payment", "PaymentCreated"},
+			{LogRecordCommand, "confirm-booking", "ConfirmBookingCommand"},
+			{LogRecordEvent, "confirm-booking", "BookingConfirmed"},
+			{LogRecordStatus, "", ""},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("log diff (-want, +got):\n %s", diff)
+		}
+
+		saga, err := ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+		assert.Equal(SagaStatusCompleted, saga.Status)
+		assert.Equal(records[len(records)-1].Revision, saga.Revision)
+	})
+
+	t.Run("when replaying from snapshot", func(t *testing.T) {
+		assert := assert.New(t)
+		log := NewInMemoryLog()
+		store := NewLogStore(log).WithSnapshotEvery(2)
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		runBookingSaga(t, sec, "1")
+
+		records, err := log.Read(ctx, "1", 0)
+		assert.Nil(err)
+		want, err := ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+
+		got, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+			t.Errorf("saga diff (-want, +got):\n %s", diff)
+		}
+	})
+
+	t.Run("when steps are skipped", func(t *testing.T) {
+		log := NewInMemoryLog()
+		// Every revision is snapshotted, so the store returns the live saga.
+		store := NewLogStore(log).WithSnapshotEvery(1)
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), newOrderSagaDefinition())
+
+		// The approval has no compensation, so it is compensated without a
+		// command, and the free order skips both of its steps.
+		handle(t, sec, OrderPlaced{ID: "1", Price: 5000}, OrderApproved{ID: "1"}, ChargeFailed{ID: "1"}, OrderCancelled{ID: "1"})
+		handle(t, sec, OrderPlaced{ID: "2"})
+
+		for _, id := range []string{"1", "2"} {
+			live, err := store.FindSaga(ctx, id)
+			require.Nil(t, err)
+			records, err := log.Read(ctx, id, 0)
+			require.Nil(t, err)
+
+			// Then replaying the log rebuilds the live saga.
+			replayed, err := ReplaySaga(Saga{}, records)
+			require.Nil(t, err)
+			if diff := cmp.Diff(live, replayed, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+				t.Errorf("saga %s diff (-live, +replayed):\n %s", id, diff)
+			}
+		}
+
+		saga, err := store.FindSaga(ctx, "1")
+		require.Nil(t, err)
+		step, err := saga.GetStep("approve-order")
+		require.Nil(t, err)
+		assert.Equal(t, StepStatusCompensated, step.Status)
+		assert.NotNil(t, step.ResponsePayload)
+	})
+
+	t.Run("when the log has the former done status", func(t *testing.T) {
+		assert := assert.New(t)
+		state, err := stateRecord(NewBookingSagaDefinition().NewSaga("1"))
+		require.Nil(t, err)
+		state.Payload = bytes.Replace(state.Payload, []byte(`"Status":"pending"`), []byte(`"Status":"done"`), 1)
+		require.Contains(t, string(state.Payload), `"Status":"done"`)
+
+		// Then the status is derived from the steps.
+		replayed, err := ReplaySaga(Saga{}, []LogRecord{state})
+		assert.Nil(err)
+		assert.Equal(SagaStatusPending, replayed.Status)
+
+		records := []LogRecord{
+			state,
+			{Type: LogRecordEvent, Step: "create-booking", StepStatus: StepStatusSuccess},
+			{Type: LogRecordEvent, Step: "create-payment", StepStatus: StepStatusFailed},
+			{Type: LogRecordStatus, SagaStatus: sagaStatusDone},
+		}
+		replayed, err = ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+		assert.Equal(SagaStatusCompensating, replayed.Status)
+
+		records = append(records,
+			LogRecord{Type: LogRecordEvent, Step: "create-booking", StepStatus: StepStatusCompensated},
+			LogRecord{Type: LogRecordStatus, SagaStatus: sagaStatusDone},
+		)
+		replayed, err = ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+		assert.Equal(SagaStatusCompensated, replayed.Status)
+	})
+
+	t.Run("when revision is stale", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewLogStore(NewInMemoryLog())
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.ErrorIs(err, ErrConcurrentModification)
+
+		_, err = store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.ErrorIs(err, ErrAlreadyExists)
+	})
+
+	t.Run("when not exists", func(t *testing.T) {
+		store := NewLogStore(NewInMemoryLog())
+
+		_, err := store.FindSaga(ctx, "1")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.UpdateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.FindSaga(ctx, "1")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestSQLLog(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	log := NewSQLLog(newSQLStore(t).db)
+	store := NewLogStore(log)
+	sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+	runBookingSaga(t, sec, "1")
+
+	records, err := log.Read(ctx, "1", 0)
+	assert.Nil(err)
+	assert.Len(records, 7)
+	for i, rec := range records {
+		assert.Equal(uint(i+1), rec.Sequence)
+	}
+
+	saga, err := store.FindSaga(ctx, "1")
+	assert.Nil(err)
+	assert.Equal(SagaStatusCompleted, saga.Status)
+
+	err = log.Append(ctx, "1", 1, []LogRecord{{Type: LogRecordStatus}})
+	assert.ErrorIs(err, ErrConcurrentModification)
+}
+
+func TestSQLStore_Log(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when sagas are updated", func(t *testing.T) {
+		store := newSQLStore(t)
+		log := NewSQLLog(store.db)
+		pub := NewInMemoryPublisher()
+		booking := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+		order := NewExecutionCoordinator(store, pub, newOrderSagaDefinition())
+
+		runBookingSaga(t, booking, "1")
+		handle(t, booking, BookingCreated{ID: "2"}, PaymentCreated{ID: "2"}, BookingRejected{ID: "2"}, PaymentRefunded{ID: "2"})
+		handle(t, order, OrderPlaced{ID: "3", Price: 5000}, OrderApproved{ID: "3"}, ChargeFailed{ID: "3"})
+
+		for _, id := range []string{"1", "2", "3"} {
+			saga, err := store.FindSaga(ctx, id)
+			require.Nil(t, err)
+			records, err := log.Read(ctx, id, 0)
+			require.Nil(t, err)
+
+			// Then the log is appended with every update, and replays to
+			// the stored saga.
+			replayed, err := ReplaySaga(Saga{}, records)
+			require.Nil(t, err)
+			if diff := cmp.Diff(saga, replayed, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+				t.Errorf("saga %s diff (-stored, +replayed):\n %s", id, diff)
+			}
+		}
+	})
+
+	t.Run("when the saga was stored before its changes were logged", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+		log := NewSQLLog(store.db)
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1"})
+		_, err := store.db.ExecContext(ctx, `DELETE FROM saga_log WHERE saga_id = '1'`)
+		require.Nil(t, err)
+
+		handle(t, sec, PaymentCreated{ID: "1"})
+
+		// Then the log starts with the state of the saga.
+		records, err := log.Read(ctx, "1", 0)
+		assert.Nil(err)
+		assert.Equal(LogRecordState, records[0].Type)
+		saga, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		replayed, err := ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+		if diff := cmp.Diff(saga, replayed, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+			t.Errorf("saga diff (-stored, +replayed):\n %s", diff)
+		}
+	})
+}
+
+func TestSQLSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := newSQLStore(t).db
+	snapshots := NewSQLSnapshots(db)
+	store := NewLogStore(NewSQLLog(db)).WithSnapshots(snapshots).WithSnapshotEvery(2)
+	sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+	runBookingSaga(t, sec, "1")
+	want, err := store.FindSaga(ctx, "1")
+	require.Nil(t, err)
+
+	// Then the snapshot is found after a restart.
+	snapshot, err := NewSQLSnapshots(db).FindSnapshot(ctx, "1")
+	assert.Nil(err)
+	assert.NotZero(snapshot.Revision)
+	assert.Equal(want.Revision-want.Revision%2, snapshot.Revision)
+
+	restarted := NewLogStore(NewSQLLog(db)).WithSnapshots(NewSQLSnapshots(db))
+	got, err := restarted.FindSaga(ctx, "1")
+	assert.Nil(err)
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+		t.Errorf("saga diff (-want, +got):\n %s", diff)
+	}
+
+	// And older snapshots do not replace it.
+	older := snapshot
+	older.Revision--
+	assert.Nil(snapshots.SaveSnapshot(ctx, older))
+	found, err := snapshots.FindSnapshot(ctx, "1")
+	assert.Nil(err)
+	assert.Equal(snapshot.Revision, found.Revision)
+
+	found, err = snapshots.FindSnapshot(ctx, "2")
+	assert.Nil(err)
+	assert.Zero(found.Revision)
+}
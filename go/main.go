@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 type event interface {
 	isEvent()
+	sagaID() string
 }
 
 type command interface {
@@ -16,68 +18,76 @@ type command interface {
 }
 
 func main() {
-	// NOTE: This is not a working example.
-	evtCh := make(chan event)
-	sagaCh := make(chan *Saga)
-	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgCh := make(chan Envelope, 10)
+	sagaCh := make(chan *Saga, 10)
+
+	// The participants reply to every command with a success event, in an
+	// envelope caused by the command.
+	createPayment := StepHandler[CreatePaymentCommand, PaymentCreated](func(ctx context.Context, cmd CreatePaymentCommand) (PaymentCreated, error) {
+		log.Printf("charge %d for booking %s\n", cmd.Amount, cmd.BookingID)
+		return PaymentCreated{ID: cmd.BookingID}, nil
+	})
+	confirmBooking := StepHandler[ConfirmBookingCommand, BookingConfirmed](func(ctx context.Context, cmd ConfirmBookingCommand) (BookingConfirmed, error) {
+		return BookingConfirmed{ID: cmd.BookingID}, nil
+	})
+	publisher := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+		log.Printf("publish command %s for step %s of saga %s\n", cmd.Type, cmd.Step, cmd.CorrelationID)
+		var (
+			reply Envelope
+			err   error
+		)
+		switch cmd.Type {
+		case typeName(CreatePaymentCommand{}):
+			reply, err = createPayment.Reply(ctx, cmd)
+		case typeName(ConfirmBookingCommand{}):
+			reply, err = confirmBooking.Reply(ctx, cmd)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msgCh <- reply
+		return nil
+	})
+	store := NewInMemoryStore()
+	sec := NewExecutionCoordinator(store, publisher, NewBookingSagaDefinition()).WithProcessedMessages(store)
 
-	sec := NewExecutionCoordinator(NewInMemoryStore())
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for {
-			select {
-			case <-done:
-				return
-			case evt := <-evtCh:
-				switch e := evt.(type) {
-				case *BookingCreated:
-					ctx := context.Background()
-					saga, err := sec.onBookingCreated(ctx, *e)
-					if err != nil {
-						log.Printf("failed to handle event bookingCreated: %s\n", err)
-						continue
-					}
-					sagaCh <- saga
-				default:
-					log.Printf("unhandled event: %s\n", e)
-				}
-			}
-		}
+		_ = sec.RunMessages(ctx, msgCh, sagaCh)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for {
-			select {
-			case <-done:
-				return
-			case saga := <-sagaCh:
-				switch status := saga.Status; status {
-				case "done":
-					continue
-				case "compensating":
-					ctx := context.Background()
-					if err := sec.CompensationFlow(ctx, *saga); err != nil {
-						log.Printf("failed to handle compensation flow: %s", err)
-					}
-				case "pending":
-					ctx := context.Background()
-					if err := sec.BookingFlow(ctx, *saga); err != nil {
-						log.Printf("failed to handle booking flow: %s", err)
-					}
-				default:
-					log.Printf("unhandled status: %s\n", status)
-				}
+		_ = sec.RunFlows(ctx, sagaCh)
+	}()
 
-			}
-		}
+	// Resume the sagas left in flight by the previous run.
+	if err := sec.Recovery().Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 
-	}()
+	env, err := NewEventEnvelope(BookingCreated{ID: "1", Amount: 100})
+	if err != nil {
+		log.Fatal(err)
+	}
+	msgCh <- env
 
-	evtCh <- BookingCreated{}
+	for {
+		saga, err := store.FindSaga(ctx, "1")
+		if err == nil && saga.Status == SagaStatusCompleted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
 
 	wg.Wait()
 	fmt.Println("completed")
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandMapper(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the booking is rejected", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+
+			handle(t, sec, BookingCreated{ID: "1", Amount: 250}, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			// Then the booking is the input of the saga.
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			var booking BookingCreated
+			assert.Nil(saga.DecodePayload(&booking))
+			assert.Equal(BookingCreated{ID: "1", Amount: 250}, booking)
+
+			// And the commands are built from the input and the
+			// responses of the previous steps.
+			commands := pub.Commands()
+			assert.Len(commands, 3)
+			var payment CreatePaymentCommand
+			assert.Nil(json.Unmarshal(commands[0].Payload, &payment))
+			assert.Equal(CreatePaymentCommand{BookingID: "1", Amount: 250}, payment)
+			var confirm ConfirmBookingCommand
+			assert.Nil(json.Unmarshal(commands[1].Payload, &confirm))
+			assert.Equal(ConfirmBookingCommand{BookingID: "1"}, confirm)
+			var refund RefundPaymentCommand
+			assert.Nil(json.Unmarshal(commands[2].Payload, &refund))
+			assert.Equal(RefundPaymentCommand{BookingID: "1", Amount: 250}, refund)
+		})
+	})
+
+	t.Run("when the mapper returns another command", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		def := NewBookingSagaDefinition()
+		stepDef, err := def.GetStep("create-payment")
+		require.Nil(t, err)
+		stepDef.MapCommand(func(saga Saga) (command, error) {
+			return RefundPaymentCommand{}, nil
+		})
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(store, pub, def)
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+
+		// Then the command is not sent.
+		assert.NotNil(sec.Continue(ctx, *saga))
+		assert.Empty(pub.Commands())
+	})
+
+	t.Run("when the step invokes no command", func(t *testing.T) {
+		def := NewSagaDefinition("booking-saga").
+			AddStep(NewStepDefinition("create-booking").
+				MapCommand(func(saga Saga) (command, error) {
+					return CreateBookingCommand{}, nil
+				}).
+				OnSuccess(BookingCreated{}))
+
+		assert.NotNil(t, def.Validate())
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// OutboxMessage is a command waiting in the outbox to be sent.
+type OutboxMessage struct {
+	ID           uint64
+	Command      CommandEnvelope
+	CreatedAt    time.Time
+	DispatchedAt *time.Time
+
+	// Attempts is the number of times the command has failed to be sent,
+	// and NextAttempt is when it is sent again, or nil if it has been given
+	// up. LastError is why the last attempt failed.
+	Attempts    int
+	NextAttempt *time.Time
+	LastError   string
+}
+
+// Outbox is implemented by repositories that store the commands of a saga in
+// the same transaction as the saga.
+type Outbox interface {
+	// PendingCommands returns up to limit commands that have not been
+	// dispatched and are due to be sent at now, oldest first.
+	PendingCommands(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error)
+
+	// MarkDispatched marks the command as sent.
+	MarkDispatched(ctx context.Context, id uint64) error
+
+	// MarkFailed records a failed attempt to send the command, which is
+	// sent again at nextAttempt, or never if nextAttempt is nil.
+	MarkFailed(ctx context.Context, id uint64, nextAttempt *time.Time, cause string) error
+}
+
+// DefaultOutboxRetryPolicy sends a command again at most every five minutes,
+// and gives up after about a day.
+var DefaultOutboxRetryPolicy = RetryPolicy{
+	MaxAttempts:    300,
+	InitialBackoff: time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// enqueue adds a command to be written to the outbox on the next update.
+func (s *Saga) enqueue(cmd CommandEnvelope) {
+	s.commands = append(s.commands, cmd)
+}
+
+// OutboxRelay sends the commands in the outbox with the publisher. A command
+// is marked as dispatched only after it is published, so it may be sent more
+// than once, but is never lost. A command that fails to be sent is retried
+// with its own backoff, and does not hold back the other commands.
+//
+// Compensation commands are retried indefinitely with the compensation retry
+// policy. The relay of the coordinator also marks their saga as stuck once
+// they have failed MaxAttempts times, and gives them up once the compensation
+// has been resolved.
+type OutboxRelay struct {
+	outbox            Outbox
+	publisher         CommandPublisher
+	policy            RetryPolicy
+	compensationRetry RetryPolicy
+	interval          time.Duration
+	batchSize         int
+	now               func() time.Time
+	// escalate is called when a compensation command has failed at least
+	// MaxAttempts times, and returns false if it is no longer awaited.
+	escalate func(ctx context.Context, cmd CommandEnvelope, attempts int, cause error) (bool, error)
+}
+
+func NewOutboxRelay(outbox Outbox, publisher CommandPublisher) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:            outbox,
+		publisher:         publisher,
+		policy:            DefaultOutboxRetryPolicy,
+		compensationRetry: DefaultCompensationRetryPolicy,
+		interval:          time.Second,
+		batchSize:         100,
+		now:               time.Now,
+	}
+}
+
+// OutboxRelay returns a relay that sends the commands in the outbox of the
+// repository with the publisher of the coordinator, and escalates the sagas
+// whose compensation commands keep failing. It panics if the repository does
+// not implement Outbox.
+func (ec *ExecutionCoordinator) OutboxRelay() *OutboxRelay {
+	outbox, ok := ec.repo.(Outbox)
+	if !ok {
+		panic(fmt.Sprintf("repository %T does not implement Outbox", ec.repo))
+	}
+	r := NewOutboxRelay(outbox, ec.publisher)
+	r.compensationRetry = ec.compensationRetry
+	r.escalate = ec.escalate
+	return r
+}
+
+// WithInterval sets how often the outbox is polled.
+func (r *OutboxRelay) WithInterval(interval time.Duration) *OutboxRelay {
+	r.interval = interval
+	return r
+}
+
+// WithRetry sets how the commands that fail to be sent are retried.
+func (r *OutboxRelay) WithRetry(policy RetryPolicy) *OutboxRelay {
+	r.policy = policy
+	return r
+}
+
+// Run relays the commands until the context is cancelled. Errors of the
+// outbox are logged, and the commands are relayed again on the next tick.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			for {
+				n, err := r.Relay(ctx)
+				if err != nil {
+					log.Printf("failed to relay commands: %s\n", err)
+					break
+				}
+				if n < r.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Relay publishes one batch of due commands, and returns the number of
+// commands relayed. Commands that fail to be sent are logged, and are sent
+// again after the backoff of the retry policy, or given up once the policy
+// does not retry them. The commands of a batch are not sent in order once
+// one of them has failed.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	msgs, err := r.outbox.PendingCommands(ctx, r.now(), r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, msg := range msgs {
+		if err := r.publisher.Publish(ctx, msg.Command); err != nil {
+			if err := r.failed(ctx, msg, err); err != nil {
+				return i, err
+			}
+			continue
+		}
+		if err := r.outbox.MarkDispatched(ctx, msg.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// failed records the failed attempt to send the command, and schedules the
+// next attempt.
+func (r *OutboxRelay) failed(ctx context.Context, msg OutboxMessage, cause error) error {
+	attempts := msg.Attempts + 1
+	policy := r.policy
+	retry := policy.retry(attempts, cause)
+	if msg.Command.Compensation {
+		policy = r.compensationRetry
+		retry = true
+		if attempts >= policy.MaxAttempts && r.escalate != nil {
+			var err error
+			if retry, err = r.escalate(ctx, msg.Command, attempts, cause); err != nil {
+				return err
+			}
+		}
+	}
+	var nextAttempt *time.Time
+	if retry {
+		next := r.now().Add(policy.Backoff(attempts))
+		nextAttempt = &next
+		log.Printf("failed to send command %s of saga %s: %s\n", msg.Command.MessageID, msg.Command.CorrelationID, cause)
+	} else {
+		log.Printf("gave up sending command %s of saga %s after %d attempts: %s\n", msg.Command.MessageID, msg.Command.CorrelationID, attempts, cause)
+	}
+	return r.outbox.MarkFailed(ctx, msg.ID, nextAttempt, cause.Error())
+}
+
+// escalate marks the saga as stuck once its compensation command has failed to
+// be sent MaxAttempts times, as dispatchFailed does for the commands published
+// directly. It returns false if the step no longer waits for the command, e.g.
+// because its dead letter has been resolved.
+func (ec *ExecutionCoordinator) escalate(ctx context.Context, cmd CommandEnvelope, attempts int, cause error) (bool, error) {
+	saga, err := ec.findSaga(ctx, cmd.CorrelationID)
+	if err != nil {
+		return false, err
+	}
+	step, err := saga.GetStep(cmd.Step)
+	if err != nil {
+		return false, err
+	}
+	if step.Status != StepStatusSuccess || step.RequestMetadata.MessageID != cmd.MessageID {
+		return false, nil
+	}
+	if saga.Status != SagaStatusCompensating {
+		return true, nil
+	}
+	step.Attempts = attempts
+	step.LastError = cause.Error()
+	if err := saga.UpdateStep(step); err != nil {
+		return false, err
+	}
+	saga.record(LogRecord{
+		Type:       LogRecordRetry,
+		Step:       step.Name,
+		StepStatus: step.Status,
+		Attempts:   step.Attempts,
+		Error:      step.LastError,
+	})
+	log.Printf("saga %s is stuck compensating step %s: %s\n", saga.ID, step.Name, cause)
+	if err := saga.transition(SagaStatusStuck); err != nil {
+		return false, err
+	}
+	if _, err := ec.repo.UpdateSaga(ctx, &saga); err != nil {
+		return false, err
+	}
+	return true, nil
+}
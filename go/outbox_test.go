@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when command is emitted", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).WithOutbox()
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+			// Then the command is not published directly.
+			assert.Empty(pub.Commands())
+
+			// And the command is in the outbox.
+			msgs, err := store.PendingCommands(ctx, time.Now(), 10)
+			assert.Nil(err)
+			assert.Len(msgs, 1)
+			assert.Equal("CreatePaymentCommand", msgs[0].Command.Type)
+
+			// When the outbox is relayed.
+			n, err := NewOutboxRelay(store, pub).Relay(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the command is published.
+			commands := pub.Commands()
+			assert.Len(commands, 1)
+			assert.Equal("1", commands[0].CorrelationID)
+			assert.Equal("create-payment", commands[0].Step)
+			assert.Equal("CreatePaymentCommand", commands[0].Type)
+			assert.JSONEq(`{"BookingID":"1","Amount":0}`, string(commands[0].Payload))
+			assert.NotEmpty(commands[0].MessageID)
+
+			// And the command is marked as dispatched.
+			msgs, err = store.PendingCommands(ctx, time.Now(), 10)
+			assert.Nil(err)
+			assert.Empty(msgs)
+		})
+
+		t.Run("when publish fails", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			handle(t, sec, BookingCreated{ID: "1"}, BookingCreated{ID: "2"})
+
+			published := NewInMemoryPublisher()
+			down := true
+			pub := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+				if down && cmd.CorrelationID == "1" {
+					return errors.New("broker unavailable")
+				}
+				return published.Publish(ctx, cmd)
+			})
+			relay := NewOutboxRelay(store, pub).WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute})
+			n, err := relay.Relay(ctx)
+			assert.Nil(err)
+			assert.Equal(2, n)
+
+			// Then the failure does not hold back the other commands.
+			commands := published.Commands()
+			assert.Len(commands, 1)
+			assert.Equal("2", commands[0].CorrelationID)
+
+			// And the command stays in the outbox until its backoff has passed.
+			msgs, err := store.PendingCommands(ctx, time.Now(), 10)
+			assert.Nil(err)
+			assert.Empty(msgs)
+			later := time.Now().Add(time.Minute)
+			msgs, err = store.PendingCommands(ctx, later, 10)
+			assert.Nil(err)
+			require.Len(t, msgs, 1)
+			assert.Equal(1, msgs[0].Attempts)
+			assert.Equal("broker unavailable", msgs[0].LastError)
+
+			// And it is sent again once it is due.
+			down = false
+			relay.now = func() time.Time { return later }
+			n, err = relay.Relay(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+			commands = published.Commands()
+			assert.Len(commands, 2)
+			assert.Equal(msgs[0].Command.MessageID, commands[1].MessageID)
+			msgs, err = store.PendingCommands(ctx, later, 10)
+			assert.Nil(err)
+			assert.Empty(msgs)
+		})
+
+		t.Run("when the command cannot be sent", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			handle(t, sec, BookingCreated{ID: "1"})
+
+			pub := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+				return Permanent(errors.New("invalid command"))
+			})
+			_, err := NewOutboxRelay(store, pub).Relay(ctx)
+			assert.Nil(err)
+
+			// Then the command is given up.
+			msgs, err := store.PendingCommands(ctx, time.Now().Add(24*time.Hour), 10)
+			assert.Nil(err)
+			assert.Empty(msgs)
+		})
+
+		t.Run("when a compensation cannot be sent", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := &failingPublisher{
+				InMemoryPublisher: NewInMemoryPublisher(),
+				typ:               "CancelBookingCommand",
+				failures:          -1,
+				err:               Permanent(errors.New("booking service unavailable")),
+			}
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).
+				WithOutbox().
+				WithCompensationRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Minute})
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentFailed{ID: "1"})
+
+			now := time.Now()
+			relay := sec.OutboxRelay()
+			relay.now = func() time.Time { return now }
+			relayed := func() int {
+				n, err := relay.Relay(ctx)
+				require.Nil(t, err)
+				now = now.Add(time.Hour)
+				return n
+			}
+			assert.Equal(2, relayed())
+
+			// Then the compensation is retried, even if the error is
+			// permanent, and the saga is stuck once it has failed
+			// MaxAttempts times.
+			assert.Equal(1, relayed())
+			found, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			assert.Equal(SagaStatusStuck, found.Status)
+			letters, err := store.DeadLetters(ctx, 10)
+			assert.Nil(err)
+			require.Len(t, letters, 1)
+			assert.Equal("create-booking", letters[0].Step)
+			assert.Equal(2, letters[0].Attempts)
+			assert.Equal(1, relayed())
+
+			// When the booking is cancelled manually.
+			_, err = sec.ResolveDeadLetter(ctx, "1", "create-booking")
+			require.Nil(t, err)
+
+			// Then the compensation is given up.
+			assert.Equal(1, relayed())
+			assert.Equal(0, relayed())
+		})
+
+		t.Run("when saga is modified concurrently", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+
+			stale := saga.clone()
+			require.Nil(t, sec.ForwardFlow(ctx, *saga))
+			assert.ErrorIs(sec.ForwardFlow(ctx, stale), ErrConcurrentModification)
+
+			// Then only the command of the saved update is in the outbox.
+			msgs, err := store.PendingCommands(ctx, time.Now(), 10)
+			assert.Nil(err)
+			assert.Len(msgs, 1)
+		})
+	})
+}
+
+func TestOutboxRelay_Run(t *testing.T) {
+	assert := assert.New(t)
+	store := NewInMemoryStore()
+	pub := NewInMemoryPublisher()
+	sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+	require.Nil(t, err)
+	require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+	done := make(chan error)
+	go func() {
+		done <- NewOutboxRelay(store, pub).WithInterval(time.Millisecond).Run(ctx)
+	}()
+
+	assert.Eventually(func() bool {
+		return len(pub.Commands()) == 1
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(<-done, context.Canceled)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	CustomerNotified   struct{ ID string }
+	NotificationFailed struct{ ID string }
+	PaymentReversed    struct{ ID string }
+
+	NotifyCustomerCommand struct{}
+)
+
+func (CustomerNotified) isEvent()   {}
+func (NotificationFailed) isEvent() {}
+func (PaymentReversed) isEvent()    {}
+
+func (e CustomerNotified) sagaID() string   { return e.ID }
+func (e NotificationFailed) sagaID() string { return e.ID }
+func (e PaymentReversed) sagaID() string    { return e.ID }
+
+func (NotifyCustomerCommand) isCommand() {}
+
+// newNotifySagaDefinition notifies the customer once the booking is
+// confirmed, which can no longer be undone.
+func newNotifySagaDefinition() *SagaDefinition {
+	return NewBookingSagaDefinition().
+		AddStep(NewStepDefinition("notify-customer").
+			Invoke(NotifyCustomerCommand{}).
+			AsRetriable().
+			WithTimeout(time.Minute).
+			OnSuccess(CustomerNotified{}).
+			OnFailure(NotificationFailed{}))
+}
+
+func TestPivot(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the pivot fails", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newNotifySagaDefinition())
+
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			// Then the steps before the pivot are compensated.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+				"RefundPaymentCommand create-payment",
+			}, steps(pub))
+		})
+
+		t.Run("when a step after the pivot fails", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newNotifySagaDefinition())
+
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingConfirmed{ID: "1"}, NotificationFailed{ID: "1"})
+
+			// Then the command is sent again instead of compensating the
+			// saga.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+				"NotifyCustomerCommand notify-customer",
+				"NotifyCustomerCommand notify-customer",
+			}, steps(pub))
+
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusPending, saga.Status)
+			step, err := saga.GetStep("notify-customer")
+			assert.Nil(err)
+			assert.Equal(StepStatusPending, step.Status)
+			assert.Equal(1, step.Attempts)
+			assert.Equal("NotificationFailed", step.LastError)
+
+			// And the command is sent again as a new message, caused by the
+			// failure.
+			commands := pub.Commands()
+			assert.NotEqual(commands[2].MessageID, commands[3].MessageID)
+			assert.Equal(step.ResponseMetadata.MessageID, commands[3].CausationID)
+
+			// And the saga completes once the step succeeds.
+			handle(t, sec, CustomerNotified{ID: "1"})
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+			step, err = saga.GetStep("notify-customer")
+			assert.Nil(err)
+			assert.Equal(0, step.Attempts)
+			assert.Empty(step.LastError)
+		})
+
+		t.Run("when a step after the pivot times out", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newNotifySagaDefinition())
+
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingConfirmed{ID: "1"})
+
+			scheduler := sec.TimeoutScheduler()
+			scheduler.now = func() time.Time { return time.Now().Add(time.Hour) }
+			n, err := scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the command is sent again with a new deadline.
+			assert.Len(pub.Commands(), 4)
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusPending, saga.Status)
+			step, err := saga.GetStep("notify-customer")
+			assert.Nil(err)
+			assert.Equal(StepStatusPending, step.Status)
+			assert.NotNil(step.Deadline)
+			assert.Equal("StepTimedOut", step.LastError)
+		})
+	})
+
+	t.Run("when the pivot is rejected after it succeeded", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingConfirmed{ID: "1"})
+
+		// Then the event is rejected, and the saga stays completed.
+		_, err := sec.HandleEvent(ctx, BookingRejected{ID: "1"})
+		assert.NotNil(err)
+		saga, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(SagaStatusCompleted, saga.Status)
+		assert.Len(pub.Commands(), 2)
+	})
+
+	t.Run("when a step fails after the saga completed", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := NewInMemoryPublisher()
+		def := NewBookingSagaDefinition()
+		step, err := def.GetStep("create-payment")
+		require.Nil(t, err)
+		step.On(PaymentReversed{}, StepStatusSuccess, StepStatusFailed)
+		sec := NewExecutionCoordinator(store, pub, def)
+		handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingConfirmed{ID: "1"})
+
+		// Then the event is acknowledged, and the saga stays completed.
+		saga, err := sec.HandleEvent(ctx, PaymentReversed{ID: "1"})
+		assert.Nil(err)
+		assert.Equal(SagaStatusCompleted, saga.Status)
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(saga.Revision, found.Revision)
+		assert.Len(pub.Commands(), 2)
+	})
+
+	t.Run("when the command of a step after the pivot cannot be sent", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := &failingPublisher{
+			InMemoryPublisher: NewInMemoryPublisher(),
+			typ:               "NotifyCustomerCommand",
+			failures:          DefaultRetryPolicy.MaxAttempts,
+			err:               Permanent(errors.New("invalid address")),
+		}
+		sec := NewExecutionCoordinator(store, pub, newNotifySagaDefinition())
+
+		handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"})
+		saga, err := sec.HandleEvent(ctx, BookingConfirmed{ID: "1"})
+		require.Nil(t, err)
+		assert.NotNil(sec.Continue(ctx, *saga))
+
+		// Then the command is retried beyond the attempts of the policy,
+		// even when the error is permanent.
+		retrier := sec.Retrier()
+		retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+		for i := 1; i < DefaultRetryPolicy.MaxAttempts; i++ {
+			_, err := retrier.Retry(ctx)
+			assert.Nil(err)
+		}
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(SagaStatusPending, found.Status)
+		step, err := found.GetStep("notify-customer")
+		assert.Nil(err)
+		assert.Equal(StepStatusPending, step.Status)
+		assert.Equal(DefaultRetryPolicy.MaxAttempts, step.Attempts)
+
+		n, err := retrier.Retry(ctx)
+		assert.Nil(err)
+		assert.Equal(1, n)
+		assert.Equal("NotifyCustomerCommand notify-customer", steps(pub.InMemoryPublisher)[2])
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDuplicateMessage is returned when a message has already been processed.
+// The message should be acknowledged without continuing the flow of its
+// saga.
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// DefaultRetention is how long processed messages are remembered by default.
+// Messages redelivered after the retention are handled again.
+const DefaultRetention = 7 * 24 * time.Hour
+
+// ProcessedMessages records the ids of the messages handled by the
+// coordinator, so that duplicate deliveries are acknowledged without being
+// applied again. Repositories that implement ProcessedMessages record the
+// message in the same transaction as the saga it updated.
+type ProcessedMessages interface {
+	// Processed reports whether the message was processed within the
+	// retention.
+	Processed(ctx context.Context, messageID string) (bool, error)
+
+	// MarkProcessed records the message as processed.
+	MarkProcessed(ctx context.Context, messageID string) error
+
+	// Purge forgets the messages processed before the retention, and returns
+	// how many were removed. It should be called periodically.
+	Purge(ctx context.Context) (int, error)
+}
+
+// InMemoryProcessedMessages is a ProcessedMessages that is safe for concurrent
+// use.
+type InMemoryProcessedMessages struct {
+	mu        sync.RWMutex
+	messages  map[string]time.Time
+	retention time.Duration
+	now       func() time.Time
+}
+
+func NewInMemoryProcessedMessages() *InMemoryProcessedMessages {
+	return &InMemoryProcessedMessages{
+		messages:  make(map[string]time.Time),
+		retention: DefaultRetention,
+		now:       time.Now,
+	}
+}
+
+// WithRetention sets how long processed messages are remembered.
+func (p *InMemoryProcessedMessages) WithRetention(retention time.Duration) *InMemoryProcessedMessages {
+	p.retention = retention
+	return p
+}
+
+func (p *InMemoryProcessedMessages) Processed(ctx context.Context, messageID string) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	processedAt, ok := p.messages[messageID]
+	return ok && !processedAt.Before(p.now().Add(-p.retention)), nil
+}
+
+func (p *InMemoryProcessedMessages) MarkProcessed(ctx context.Context, messageID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages[messageID] = p.now()
+	return nil
+}
+
+// claim records the message, and returns ErrDuplicateMessage if it was
+// processed within the retention.
+func (p *InMemoryProcessedMessages) claim(messageID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if processedAt, ok := p.messages[messageID]; ok && !processedAt.Before(now.Add(-p.retention)) {
+		return ErrDuplicateMessage
+	}
+	p.messages[messageID] = now
+	return nil
+}
+
+func (p *InMemoryProcessedMessages) Purge(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	before := p.now().Add(-p.retention)
+	var n int
+	for id, processedAt := range p.messages {
+		if processedAt.Before(before) {
+			delete(p.messages, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessedMessages(t *testing.T) {
+	ctx := context.Background()
+
+	stores := map[string]func(t *testing.T, now func() time.Time) ProcessedMessages{
+		"in memory": func(t *testing.T, now func() time.Time) ProcessedMessages {
+			p := NewInMemoryProcessedMessages().WithRetention(time.Hour)
+			p.now = now
+			return p
+		},
+		"sql": func(t *testing.T, now func() time.Time) ProcessedMessages {
+			p := NewSQLProcessedMessages(newSQLStore(t).db).WithRetention(time.Hour)
+			p.now = now
+			return p
+		},
+		"in memory store": func(t *testing.T, now func() time.Time) ProcessedMessages {
+			store := NewInMemoryStore().WithRetention(time.Hour)
+			store.processed.now = now
+			return store
+		},
+		"sql store": func(t *testing.T, now func() time.Time) ProcessedMessages {
+			store := newSQLStore(t).WithRetention(time.Hour)
+			store.processed.now = now
+			return store
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			p := newStore(t, func() time.Time { return now })
+
+			processed, err := p.Processed(ctx, "1")
+			assert.Nil(err)
+			assert.False(processed)
+
+			assert.Nil(p.MarkProcessed(ctx, "1"))
+			assert.Nil(p.MarkProcessed(ctx, "1"))
+			processed, err = p.Processed(ctx, "1")
+			assert.Nil(err)
+			assert.True(processed)
+
+			// When the retention has passed.
+			now = now.Add(time.Hour + time.Second)
+			assert.Nil(p.MarkProcessed(ctx, "2"))
+
+			processed, err = p.Processed(ctx, "1")
+			assert.Nil(err)
+			assert.False(processed)
+
+			n, err := p.Purge(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			processed, err = p.Processed(ctx, "2")
+			assert.Nil(err)
+			assert.True(processed)
+		})
+	}
+}
+
+func TestExecutionCoordinator_ProcessedMessages(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		processed := map[string]func(store testStore) ProcessedMessages{
+			"separately": func(store testStore) ProcessedMessages {
+				return NewInMemoryProcessedMessages()
+			},
+			"by the repository": func(store testStore) ProcessedMessages {
+				return store
+			},
+		}
+
+		for name, newProcessed := range processed {
+			t.Run(name, func(t *testing.T) {
+				t.Run("when the first event is delivered again", func(t *testing.T) {
+					assert := assert.New(t)
+					store := newStore(t)
+					pub := NewInMemoryPublisher()
+					sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).
+						WithProcessedMessages(newProcessed(store))
+
+					env, err := NewEventEnvelope(BookingCreated{ID: "1"})
+					require.Nil(t, err)
+					saga, err := sec.HandleMessage(ctx, env)
+					require.Nil(t, err)
+					require.Nil(t, sec.ForwardFlow(ctx, *saga))
+					handle(t, sec, PaymentCreated{ID: "1"})
+
+					found, err := store.FindSaga(ctx, "1")
+					require.Nil(t, err)
+
+					// Then the event is acknowledged as a duplicate, without
+					// modifying the saga.
+					_, err = sec.HandleMessage(ctx, env)
+					assert.ErrorIs(err, ErrDuplicateMessage)
+					again, err := store.FindSaga(ctx, "1")
+					assert.Nil(err)
+					assert.Equal(found.Revision, again.Revision)
+					assert.Len(pub.Commands(), 2)
+				})
+
+				t.Run("when a step event is delivered again", func(t *testing.T) {
+					assert := assert.New(t)
+					store := newStore(t)
+					pub := NewInMemoryPublisher()
+					sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).
+						WithProcessedMessages(newProcessed(store))
+					handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"})
+
+					env, err := NewEventEnvelope(BookingRejected{ID: "1"})
+					require.Nil(t, err)
+					saga, err := sec.HandleMessage(ctx, env)
+					require.Nil(t, err)
+					require.Nil(t, sec.CompensationFlow(ctx, *saga))
+
+					found, err := store.FindSaga(ctx, "1")
+					require.Nil(t, err)
+
+					// Then the event is acknowledged as a duplicate, without
+					// modifying the saga.
+					_, err = sec.HandleMessage(ctx, env)
+					assert.ErrorIs(err, ErrDuplicateMessage)
+					again, err := store.FindSaga(ctx, "1")
+					assert.Nil(err)
+					assert.Equal(found.Revision, again.Revision)
+					assert.Len(pub.Commands(), 3)
+				})
+			})
+		}
+
+		t.Run("when the message is recorded with the update", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).
+				WithProcessedMessages(store)
+			handle(t, sec, BookingCreated{ID: "1"})
+
+			env, err := NewEventEnvelope(PaymentCreated{ID: "1"})
+			require.Nil(t, err)
+			_, err = sec.HandleMessage(ctx, env)
+			require.Nil(t, err)
+
+			// Then the message is processed once the saga is updated.
+			processed, err := store.Processed(ctx, env.MessageID)
+			assert.Nil(err)
+			assert.True(processed)
+
+			// And a concurrent update with the same message is rejected.
+			saga, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			saga.processed = env.MessageID
+			_, err = store.UpdateSaga(ctx, &saga)
+			assert.ErrorIs(err, ErrDuplicateMessage)
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(saga.Revision, found.Revision)
+		})
+	})
+
+	t.Run("when the message recorded with the update does not change the saga", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).
+			WithProcessedMessages(store)
+		handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"})
+
+		env, err := NewEventEnvelope(PaymentCreated{ID: "1"})
+		require.Nil(t, err)
+		saga, err := sec.HandleMessage(ctx, env)
+		require.Nil(t, err)
+		assert.Nil(sec.Continue(ctx, *saga))
+
+		// Then the message is processed without an update.
+		processed, err := store.Processed(ctx, env.MessageID)
+		assert.Nil(err)
+		assert.True(processed)
+		_, err = sec.HandleMessage(ctx, env)
+		assert.ErrorIs(err, ErrDuplicateMessage)
+	})
+
+	t.Run("when the first event was not marked as processed", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		env, err := NewEventEnvelope(BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		saga, err := sec.HandleMessage(ctx, env)
+		require.Nil(t, err)
+
+		// Then the event is acknowledged as a duplicate of the event that
+		// started the saga.
+		_, err = sec.HandleMessage(ctx, env)
+		assert.ErrorIs(err, ErrDuplicateMessage)
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(saga.Revision, found.Revision)
+
+		// And another event starting the same saga is rejected.
+		_, err = sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		assert.ErrorIs(err, ErrAlreadyExists)
+	})
+}
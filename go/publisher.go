@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// CommandPublisher sends commands to the saga participants.
+type CommandPublisher interface {
+	Publish(ctx context.Context, cmd CommandEnvelope) error
+}
+
+type PublisherFunc func(ctx context.Context, cmd CommandEnvelope) error
+
+func (fn PublisherFunc) Publish(ctx context.Context, cmd CommandEnvelope) error {
+	return fn(ctx, cmd)
+}
+
+// InMemoryPublisher records the published commands.
+type InMemoryPublisher struct {
+	mu       sync.RWMutex
+	commands []CommandEnvelope
+}
+
+func NewInMemoryPublisher() *InMemoryPublisher {
+	return &InMemoryPublisher{}
+}
+
+func (p *InMemoryPublisher) Publish(ctx context.Context, cmd CommandEnvelope) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cmd.Payload = cloneBytes(cmd.Payload)
+	p.commands = append(p.commands, cmd)
+	return nil
+}
+
+// Commands returns the published commands in order.
+func (p *InMemoryPublisher) Commands() []CommandEnvelope {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	commands := make([]CommandEnvelope, len(p.commands))
+	copy(commands, p.commands)
+	return commands
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ActiveSagas is implemented by repositories that can find the sagas that
+// have not reached a terminal status.
+type ActiveSagas interface {
+	// ActiveSagas returns the ids of up to limit sagas that are not in a
+	// terminal status, with an id after the given one, in id order.
+	ActiveSagas(ctx context.Context, after string, limit int) ([]string, error)
+}
+
+// Recovery resumes the sagas left in flight when the coordinator stopped.
+// The command of a step is saved before it is sent, so the commands that were
+// lost are sent again, and commands that were already sent may be delivered
+// twice, with the same message id.
+type Recovery struct {
+	coordinator *ExecutionCoordinator
+	sagas       ActiveSagas
+	batchSize   int
+	// after is the id of the last saga resumed, and done is set once every
+	// saga has been resumed.
+	after string
+	done  bool
+}
+
+// Recovery returns a recovery for the sagas in the repository. It panics if
+// the repository does not implement ActiveSagas.
+func (ec *ExecutionCoordinator) Recovery() *Recovery {
+	sagas, ok := ec.repo.(ActiveSagas)
+	if !ok {
+		panic(fmt.Sprintf("repository %T does not implement ActiveSagas", ec.repo))
+	}
+	return &Recovery{
+		coordinator: ec,
+		sagas:       sagas,
+		batchSize:   100,
+	}
+}
+
+// Run resumes every saga in flight once, and returns when all of them have
+// been resumed or the context is cancelled. It is meant to be run when the
+// coordinator starts, before new events are handled.
+func (r *Recovery) Run(ctx context.Context) error {
+	for !r.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := r.Recover(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recover resumes the flow of the next batch of sagas in flight, and
+// returns the number of sagas continued. Sagas that fail are logged and
+// skipped, and are left to the Retrier and the TimeoutScheduler. Stuck sagas
+// are skipped, they wait for their dead letters to be redriven.
+func (r *Recovery) Recover(ctx context.Context) (int, error) {
+	if r.done {
+		return 0, nil
+	}
+	ids, err := r.sagas.ActiveSagas(ctx, r.after, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) < r.batchSize {
+		r.done = true
+	}
+
+	var n int
+	for _, id := range ids {
+		r.after = id
+		saga, err := r.coordinator.findSaga(ctx, id)
+		if err == nil && saga.Status == SagaStatusStuck {
+			continue
+		}
+		if err == nil {
+			err = r.coordinator.Resume(ctx, saga)
+		}
+		if err != nil {
+			log.Printf("failed to recover saga %s: %s\n", id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Resume continues the flow of the saga, and sends again the commands the
+// saga is waiting for, in case they were lost when the coordinator stopped.
+// Commands saved to the outbox are left to the OutboxRelay.
+func (ec *ExecutionCoordinator) Resume(ctx context.Context, saga Saga) error {
+	if !ec.outbox {
+		def, err := ec.definition(saga.Name, saga.Version)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, stepDef := range def.Steps {
+			step, err := saga.GetStep(stepDef.Name)
+			if err != nil {
+				return err
+			}
+			waiting := step.awaiting() && step.sent(stepDef.Command) ||
+				step.Status == StepStatusSuccess && stepDef.Compensation != nil && step.sent(stepDef.Compensation)
+			if !waiting || step.NextRetry != nil {
+				continue
+			}
+			// The command is due, so that the flow sends it again.
+			step.NextRetry = &now
+			if err := saga.UpdateStep(step); err != nil {
+				return err
+			}
+		}
+	}
+	return ec.Continue(ctx, saga)
+}
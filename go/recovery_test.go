@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashingPublisher panics when a command of the given type is published, as
+// if the process died after the command was saved but before it was sent.
+type crashingPublisher struct {
+	*InMemoryPublisher
+	typ string
+}
+
+func (p *crashingPublisher) Publish(ctx context.Context, cmd CommandEnvelope) error {
+	if cmd.Type == p.typ {
+		panic("crash")
+	}
+	return p.InMemoryPublisher.Publish(ctx, cmd)
+}
+
+// crash handles the events, and then continues the saga of the last event
+// with a publisher that crashes on the commands of the given type.
+func crash(t *testing.T, store repository, typ string, events ...event) {
+	t.Helper()
+
+	pub := &crashingPublisher{InMemoryPublisher: NewInMemoryPublisher(), typ: typ}
+	sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+	handle(t, sec, events[:len(events)-1]...)
+	saga, err := sec.HandleEvent(context.Background(), events[len(events)-1])
+	require.Nil(t, err)
+	require.Panics(t, func() {
+		_ = sec.Continue(context.Background(), *saga)
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the coordinator stops during the booking flow", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			crash(t, store, "ConfirmBookingCommand", BookingCreated{ID: "1"}, PaymentCreated{ID: "1"})
+
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			assert.Nil(sec.Recovery().Run(ctx))
+
+			// Then the lost command is sent again, and the saga completes.
+			assert.Equal([]string{"ConfirmBookingCommand confirm-booking"}, steps(pub))
+			handle(t, sec, BookingConfirmed{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+		})
+
+		t.Run("when the coordinator stops during the compensation flow", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			crash(t, store, "RefundPaymentCommand", BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			assert.Nil(sec.Recovery().Run(ctx))
+
+			// Then the compensation continues where it stopped.
+			assert.Equal([]string{"RefundPaymentCommand create-payment"}, steps(pub))
+			handle(t, sec, PaymentRefunded{ID: "1"}, BookingCancelled{ID: "1"})
+			assert.Equal([]string{
+				"RefundPaymentCommand create-payment",
+				"CancelBookingCommand create-booking",
+			}, steps(pub))
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompensated, saga.Status)
+		})
+
+		t.Run("when the coordinator stops with commands in the outbox", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			handle(t, sec, BookingCreated{ID: "1"})
+
+			// The relay crashes after the command is sent but before it is
+			// marked as dispatched.
+			pub := NewInMemoryPublisher()
+			crashing := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+				require.Nil(t, pub.Publish(ctx, cmd))
+				panic("crash")
+			})
+			require.Panics(t, func() {
+				_, _ = NewOutboxRelay(store, crashing).Relay(ctx)
+			})
+
+			sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			assert.Nil(sec.Recovery().Run(ctx))
+			n, err := NewOutboxRelay(store, pub).Relay(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the command is sent again with the same message ID.
+			saga, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			step, err := saga.GetStep("create-payment")
+			require.Nil(t, err)
+			commands := pub.Commands()
+			assert.Len(commands, 2)
+			for _, cmd := range commands {
+				assert.Equal(step.RequestMetadata.MessageID, cmd.MessageID)
+			}
+
+			// When the coordinator stops before the saga continues after
+			// the event, and is restarted twice.
+			_, err = sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+			require.Nil(t, err)
+			assert.Nil(sec.Recovery().Run(ctx))
+			assert.Nil(sec.Recovery().Run(ctx))
+			n, err = NewOutboxRelay(store, pub).Relay(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the next command is sent once.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+			}, steps(pub))
+			msgs, err := store.PendingCommands(ctx, time.Now(), 10)
+			assert.Nil(err)
+			assert.Empty(msgs)
+		})
+
+		t.Run("when the coordinator stops with compensations in the outbox", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			handle(t, sec, BookingCreated{ID: "1"}, PaymentCreated{ID: "1"}, BookingRejected{ID: "1"})
+
+			sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition()).WithOutbox()
+			assert.Nil(sec.Recovery().Run(ctx))
+			pub := NewInMemoryPublisher()
+			_, err := NewOutboxRelay(store, pub).Relay(ctx)
+			assert.Nil(err)
+
+			// Then every command is sent once, and none is enqueued again.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+				"RefundPaymentCommand create-payment",
+			}, steps(pub))
+			ids := map[string]bool{}
+			for _, cmd := range pub.Commands() {
+				assert.False(ids[cmd.MessageID])
+				ids[cmd.MessageID] = true
+			}
+		})
+
+		t.Run("when there are more sagas than a batch", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+			for _, id := range []string{"1", "2", "3"} {
+				_, err := sec.HandleEvent(ctx, BookingCreated{ID: id})
+				require.Nil(t, err)
+			}
+			handle(t, sec, BookingCreated{ID: "4"}, PaymentCreated{ID: "4"}, BookingConfirmed{ID: "4"})
+
+			pub := NewInMemoryPublisher()
+			sec = NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			recovery := sec.Recovery()
+			recovery.batchSize = 2
+			assert.Nil(recovery.Run(ctx))
+
+			// Then every saga in flight is resumed once, and the completed
+			// saga is left alone.
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"CreatePaymentCommand create-payment",
+				"CreatePaymentCommand create-payment",
+			}, steps(pub))
+			ids, err := store.ActiveSagas(ctx, "", 10)
+			assert.Nil(err)
+			assert.Equal([]string{"1", "2", "3"}, ids)
+
+			n, err := recovery.Recover(ctx)
+			assert.Nil(err)
+			assert.Zero(n)
+		})
+	})
+}
@@ -3,35 +3,274 @@ package main
 import (
 	"context"
 	"errors"
+	"sort"
+	"sync"
+	"time"
 )
 
+// ErrNotFound is returned when the saga does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConcurrentModification is returned when the saga has been updated since
+// it was last read.
+var ErrConcurrentModification = errors.New("concurrent modification")
+
+// ErrAlreadyExists is returned when creating a saga with an id that is taken.
+var ErrAlreadyExists = errors.New("already exists")
+
+// InMemoryStore is safe for concurrent use. Sagas are copied on read and write,
+// so callers never share steps or payloads with the stored saga.
 type InMemoryStore struct {
-	sagas map[string]Saga
+	mu        sync.RWMutex
+	sagas     map[string]Saga
+	ids       IDGenerator
+	outbox    []OutboxMessage
+	processed *InMemoryProcessedMessages
 }
 
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
-		sagas: make(map[string]Saga),
+		sagas:     make(map[string]Saga),
+		ids:       UUIDGenerator{},
+		processed: NewInMemoryProcessedMessages(),
 	}
 }
 
+// WithIDGenerator sets the generator for sagas created without an id.
+func (r *InMemoryStore) WithIDGenerator(ids IDGenerator) *InMemoryStore {
+	r.ids = ids
+	return r
+}
+
+// WithRetention sets how long processed messages are remembered.
+func (r *InMemoryStore) WithRetention(retention time.Duration) *InMemoryStore {
+	r.processed.WithRetention(retention)
+	return r
+}
+
 func (r *InMemoryStore) FindSaga(ctx context.Context, id string) (Saga, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	saga, ok := r.sagas[id]
 	if !ok {
-		return Saga{}, errors.New("not found")
+		return Saga{}, ErrNotFound
 	}
-	return saga, nil
+	return saga.clone(), nil
 }
 
+// UpdateSaga saves the saga only if the stored revision matches the revision of
+// the given saga. It returns ErrNotFound if the saga does not exist.
 func (r *InMemoryStore) UpdateSaga(ctx context.Context, saga *Saga) (Saga, error) {
-	cp := *saga
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cp := saga.clone()
+	stored, ok := r.sagas[cp.ID]
+	if !ok {
+		return Saga{}, ErrNotFound
+	}
+	if stored.Revision != cp.Revision {
+		return Saga{}, ErrConcurrentModification
+	}
+	if saga.processed != "" {
+		if err := r.processed.claim(saga.processed); err != nil {
+			return Saga{}, err
+		}
+	}
+	cp.Revision++
 	r.sagas[cp.ID] = cp
-	return cp, nil
+	r.enqueue(saga.commands)
+	return cp.clone(), nil
 }
 
+// CreateSaga stores a new saga, generating an id if the saga has none.
 func (r *InMemoryStore) CreateSaga(ctx context.Context, saga *Saga) (Saga, error) {
-	cp := *saga
-	cp.ID = "1"
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cp := saga.clone()
+	if cp.ID == "" {
+		id, err := r.ids.NewID()
+		if err != nil {
+			return Saga{}, err
+		}
+		cp.ID = id
+	}
+	if _, ok := r.sagas[cp.ID]; ok {
+		return Saga{}, ErrAlreadyExists
+	}
+	if saga.processed != "" {
+		if err := r.processed.claim(saga.processed); err != nil {
+			return Saga{}, err
+		}
+	}
+	cp.Revision = 1
 	r.sagas[cp.ID] = cp
-	return cp, nil
+	r.enqueue(saga.commands)
+	return cp.clone(), nil
+}
+
+// enqueue writes the commands to the outbox. The caller must hold the lock.
+func (r *InMemoryStore) enqueue(commands []CommandEnvelope) {
+	now := time.Now()
+	for _, cmd := range commands {
+		cmd.Payload = cloneBytes(cmd.Payload)
+		r.outbox = append(r.outbox, OutboxMessage{
+			ID:        uint64(len(r.outbox) + 1),
+			Command:   cmd,
+			CreatedAt: now,
+		})
+	}
+}
+
+func (r *InMemoryStore) PendingCommands(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var msgs []OutboxMessage
+	for _, msg := range r.outbox {
+		if len(msgs) == limit {
+			break
+		}
+		due := msg.Attempts == 0 || msg.NextAttempt != nil && !msg.NextAttempt.After(now)
+		if msg.DispatchedAt == nil && due {
+			msg.Command.Payload = cloneBytes(msg.Command.Payload)
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (r *InMemoryStore) MarkDispatched(ctx context.Context, id uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == 0 || id > uint64(len(r.outbox)) {
+		return ErrNotFound
+	}
+	now := time.Now()
+	r.outbox[id-1].DispatchedAt = &now
+	return nil
+}
+
+func (r *InMemoryStore) MarkFailed(ctx context.Context, id uint64, nextAttempt *time.Time, cause string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == 0 || id > uint64(len(r.outbox)) {
+		return ErrNotFound
+	}
+	msg := &r.outbox[id-1]
+	msg.Attempts++
+	msg.NextAttempt = nil
+	if nextAttempt != nil {
+		next := *nextAttempt
+		msg.NextAttempt = &next
+	}
+	msg.LastError = cause
+	return nil
+}
+
+func (r *InMemoryStore) Processed(ctx context.Context, messageID string) (bool, error) {
+	return r.processed.Processed(ctx, messageID)
+}
+
+func (r *InMemoryStore) MarkProcessed(ctx context.Context, messageID string) error {
+	return r.processed.MarkProcessed(ctx, messageID)
+}
+
+func (r *InMemoryStore) Purge(ctx context.Context) (int, error) {
+	return r.processed.Purge(ctx)
+}
+
+func (r *InMemoryStore) ExpiredSteps(ctx context.Context, now time.Time, limit int) ([]ExpiredStep, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var steps []ExpiredStep
+	for _, saga := range r.sagas {
+		for _, step := range saga.Steps {
+			if step.Status == StepStatusPending && step.Deadline != nil && !step.Deadline.After(now) {
+				steps = append(steps, ExpiredStep{
+					SagaID:   saga.ID,
+					Step:     step.Name,
+					Deadline: *step.Deadline,
+				})
+			}
+		}
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].Deadline.Before(steps[j].Deadline)
+	})
+	if len(steps) > limit {
+		steps = steps[:limit]
+	}
+	return steps, nil
+}
+
+func (r *InMemoryStore) DueRetries(ctx context.Context, now time.Time, limit int) ([]DueRetry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var retries []DueRetry
+	for _, saga := range r.sagas {
+		for _, step := range saga.Steps {
+			if step.NextRetry != nil && !step.NextRetry.After(now) {
+				retries = append(retries, DueRetry{
+					SagaID:    saga.ID,
+					Step:      step.Name,
+					NextRetry: *step.NextRetry,
+				})
+			}
+		}
+	}
+	sort.Slice(retries, func(i, j int) bool {
+		return retries[i].NextRetry.Before(retries[j].NextRetry)
+	})
+	if len(retries) > limit {
+		retries = retries[:limit]
+	}
+	return retries, nil
+}
+
+func (r *InMemoryStore) ActiveSagas(ctx context.Context, after string, limit int) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ids []string
+	for id, saga := range r.sagas {
+		if id > after && !saga.Status.Terminal() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (r *InMemoryStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var letters []DeadLetter
+	for _, saga := range r.sagas {
+		if saga.Status != SagaStatusStuck {
+			continue
+		}
+		for _, step := range saga.Steps {
+			if step.Status == StepStatusSuccess && step.Attempts > 0 {
+				letters = append(letters, newDeadLetter(saga, step))
+			}
+		}
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].SagaID < letters[j].SagaID
+	})
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
 }
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,8 +33,215 @@ func TestRepo_FindSaga(t *testing.T) {
 
 		saga, err := store.FindSaga(ctx, created.ID)
 		assert.Nil(err)
-		if diff := cmp.Diff(created, saga); diff != "" {
+		if diff := cmp.Diff(created, saga, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
 			t.Errorf("saga diff (-want, +got):\n %s", diff)
 		}
 	})
 }
+
+func TestRepo_UpdateSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when revision matches", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		created, err := store.CreateSaga(ctx, &Saga{Name: "hello"})
+		assert.Nil(err)
+
+		updated, err := store.UpdateSaga(ctx, &created)
+		assert.Nil(err)
+		assert.Equal(created.Revision+1, updated.Revision)
+	})
+
+	t.Run("when revision is stale", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		created, err := store.CreateSaga(ctx, &Saga{Name: "hello"})
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.ErrorIs(err, ErrConcurrentModification)
+	})
+
+	t.Run("when not exists", func(t *testing.T) {
+		store := NewInMemoryStore()
+
+		_, err := store.UpdateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestRepo_Copy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when mutating a found saga", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga(""))
+		assert.Nil(err)
+
+		saga, err := store.FindSaga(ctx, created.ID)
+		assert.Nil(err)
+		saga.Steps[0].Status = StepStatusSuccess
+		saga.Steps[0].RequestPayload = []byte("{}")
+
+		found, err := store.FindSaga(ctx, created.ID)
+		assert.Nil(err)
+		assert.Equal(StepStatusPending, found.Steps[0].Status)
+		assert.Nil(found.Steps[0].RequestPayload)
+	})
+
+	t.Run("when mutating an updated saga", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.Nil(err)
+		saga := &created
+		saga.Payload = []byte("{}")
+		_, err = store.UpdateSaga(ctx, saga)
+		assert.Nil(err)
+
+		saga.Steps[0].Status = StepStatusSuccess
+		saga.Payload[0] = '['
+
+		found, err := store.FindSaga(ctx, saga.ID)
+		assert.Nil(err)
+		assert.Equal(StepStatusPending, found.Steps[0].Status)
+		assert.Equal([]byte("{}"), found.Payload)
+	})
+}
+
+// Run with the race detector enabled, go test -race.
+func TestRepo_Concurrency(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when updating the same saga concurrently", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga(""))
+		assert.Nil(err)
+
+		const n = 50
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			updated   int
+			conflicts int
+		)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				saga, err := store.FindSaga(ctx, created.ID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				saga.Steps[0].Status = StepStatusSuccess
+
+				_, err = store.UpdateSaga(ctx, &saga)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					updated++
+				case errors.Is(err, ErrConcurrentModification):
+					conflicts++
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		saga, err := store.FindSaga(ctx, created.ID)
+		assert.Nil(err)
+		assert.Equal(n, updated+conflicts)
+		assert.Equal(created.Revision+uint(updated), saga.Revision)
+	})
+
+	t.Run("when handling events concurrently", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+
+		ids := []string{"1", "2", "3", "4", "5"}
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+
+				saga, err := sec.HandleEvent(ctx, BookingCreated{ID: id})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := sec.ForwardFlow(ctx, *saga); err != nil {
+					t.Error(err)
+				}
+			}(id)
+		}
+		wg.Wait()
+
+		for _, id := range ids {
+			saga, err := store.FindSaga(ctx, id)
+			assert.Nil(err)
+
+			step, err := saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.NotNil(step.RequestPayload)
+		}
+	})
+}
+
+func TestRepo_CreateSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when id is empty", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		first, err := store.CreateSaga(ctx, &Saga{Name: "hello"})
+		assert.Nil(err)
+
+		second, err := store.CreateSaga(ctx, &Saga{Name: "hello"})
+		assert.Nil(err)
+
+		assert.NotEmpty(first.ID)
+		assert.NotEqual(first.ID, second.ID)
+	})
+
+	t.Run("when id is supplied", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		saga, err := store.CreateSaga(ctx, &Saga{ID: "booking-1", Name: "hello"})
+		assert.Nil(err)
+		assert.Equal("booking-1", saga.ID)
+
+		_, err = store.CreateSaga(ctx, &Saga{ID: "booking-1", Name: "hello"})
+		assert.ErrorIs(err, ErrAlreadyExists)
+	})
+
+	t.Run("when id generator is set", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore().WithIDGenerator(IDGeneratorFunc(func() (string, error) {
+			return "generated", nil
+		}))
+
+		saga, err := store.CreateSaga(ctx, &Saga{Name: "hello"})
+		assert.Nil(err)
+		assert.Equal("generated", saga.ID)
+	})
+}
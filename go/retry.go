@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how the command of a step is sent again when it
+// cannot be published.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times the command is sent, including the
+	// first attempt.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the second attempt. The delay is
+	// multiplied by Multiplier after every attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter randomizes the delay by up to the given fraction, so that
+	// sagas failing together are not retried together.
+	Jitter float64
+
+	// Retryable reports whether the command is sent again after the error.
+	// All errors but permanent errors are retried when nil.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy sends a command up to 5 times over about half a minute.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// DefaultCompensationRetryPolicy retries compensations at most every five
+// minutes, and marks the saga as stuck after 10 attempts.
+var DefaultCompensationRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Backoff returns the delay after the given attempt, starting at 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(backoff)
+}
+
+// retry reports whether the command is sent again after the given attempt
+// failed with the error.
+func (p RetryPolicy) retry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks the error as not retryable, e.g. when a publisher rejects a
+// command that can never be sent.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// IsRetryable returns false if the error has been marked as permanent.
+func IsRetryable(err error) bool {
+	var permanent permanentError
+	return !errors.As(err, &permanent)
+}
+
+// retryForward keeps a retriable step pending when it fails, and schedules a
+// new command to be sent with the retry policy of the step. The failure is
+// recorded as the response of the step, so that it is not applied twice, and
+// the new command is caused by the failure.
+func retryForward(def *SagaDefinition, saga *Saga, stepDef *StepDefinition, step Step, env Envelope, evt event) error {
+	attempts := step.Attempts + 1
+	if err := applyEvent(saga, step, StepStatusPending, env, evt); err != nil {
+		return err
+	}
+	cmd, err := stepDef.buildCommand(*saga, StepStatusPending)
+	if err != nil {
+		return err
+	}
+	cmdEnv, err := newEnvelope(def.codec(), def.schemaVersion(), saga.ID, env.MessageID, cmd)
+	if err != nil {
+		return err
+	}
+	step, err = saga.GetStep(stepDef.Name)
+	if err != nil {
+		return err
+	}
+	nextRetry := time.Now().Add(stepDef.retryPolicy().Backoff(attempts))
+	step.RequestPayload = cmdEnv.Payload
+	step.RequestMetadata = cmdEnv.Metadata.clone()
+	step.Attempts = attempts
+	step.NextRetry = &nextRetry
+	step.LastError = typeName(evt)
+	if err := saga.UpdateStep(step); err != nil {
+		return err
+	}
+	saga.record(LogRecord{
+		Type:     LogRecordCommand,
+		Step:     step.Name,
+		Name:     cmdEnv.Type,
+		Metadata: cmdEnv.Metadata,
+		Payload:  cmdEnv.Payload,
+	})
+	saga.record(LogRecord{
+		Type:       LogRecordRetry,
+		Step:       step.Name,
+		StepStatus: step.Status,
+		Attempts:   step.Attempts,
+		NextRetry:  step.NextRetry,
+		Error:      step.LastError,
+	})
+	return nil
+}
+
+// DueRetry is a step whose command is due to be sent again.
+type DueRetry struct {
+	SagaID    string
+	Step      string
+	NextRetry time.Time
+}
+
+// Retries is implemented by repositories that can find the steps whose
+// command is due to be sent again.
+type Retries interface {
+	// DueRetries returns up to limit steps with a next retry at or before
+	// now, earliest first.
+	DueRetries(ctx context.Context, now time.Time, limit int) ([]DueRetry, error)
+}
+
+// Retrier resumes the sagas whose commands could not be sent, once their
+// backoff has passed.
+type Retrier struct {
+	coordinator *ExecutionCoordinator
+	retries     Retries
+	interval    time.Duration
+	batchSize   int
+	now         func() time.Time
+}
+
+// Retrier returns a retrier for the sagas in the repository. It panics if the
+// repository does not implement Retries.
+func (ec *ExecutionCoordinator) Retrier() *Retrier {
+	retries, ok := ec.repo.(Retries)
+	if !ok {
+		panic(fmt.Sprintf("repository %T does not implement Retries", ec.repo))
+	}
+	return &Retrier{
+		coordinator: ec,
+		retries:     retries,
+		interval:    time.Second,
+		batchSize:   100,
+		now:         time.Now,
+	}
+}
+
+// WithInterval sets how often the retries are checked.
+func (r *Retrier) WithInterval(interval time.Duration) *Retrier {
+	r.interval = interval
+	return r
+}
+
+// Run retries the commands until the context is cancelled.
+func (r *Retrier) Run(ctx context.Context) error {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			for {
+				n, err := r.Retry(ctx)
+				if err != nil || n < r.batchSize {
+					// The retries are checked again on the next tick.
+					break
+				}
+			}
+		}
+	}
+}
+
+// Retry continues the sagas of one batch of due retries, and returns the
+// number of sagas continued. Sagas that fail again are logged and skipped,
+// and are retried after their next backoff.
+func (r *Retrier) Retry(ctx context.Context) (int, error) {
+	retries, err := r.retries.DueRetries(ctx, r.now(), r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, retry := range retries {
+		saga, err := r.coordinator.findSaga(ctx, retry.SagaID)
+		if err == nil {
+			err = r.coordinator.Continue(ctx, saga)
+		}
+		if err != nil {
+			log.Printf("failed to retry step %s of saga %s: %s\n", retry.Step, retry.SagaID, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingPublisher fails to publish the commands of the given type until
+// failures reaches zero, or forever if failures is negative.
+type failingPublisher struct {
+	*InMemoryPublisher
+	mu       sync.Mutex
+	typ      string
+	failures int
+	err      error
+}
+
+func (p *failingPublisher) Publish(ctx context.Context, cmd CommandEnvelope) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cmd.Type == p.typ && p.failures != 0 {
+		p.failures--
+		return p.err
+	}
+	return p.InMemoryPublisher.Publish(ctx, cmd)
+}
+
+func newRetrySagaDefinition(t *testing.T, policy RetryPolicy) *SagaDefinition {
+	def := NewBookingSagaDefinition()
+	step, err := def.GetStep("create-payment")
+	require.Nil(t, err)
+	step.WithRetry(policy)
+	return def
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	assert := assert.New(t)
+	policy := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+	}
+
+	assert.Equal(time.Second, policy.Backoff(1))
+	assert.Equal(2*time.Second, policy.Backoff(2))
+	assert.Equal(4*time.Second, policy.Backoff(3))
+	assert.Equal(5*time.Second, policy.Backoff(4))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert.GreaterOrEqual(backoff, time.Second)
+		assert.LessOrEqual(backoff, 3*time.Second)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert := assert.New(t)
+	err := errors.New("rejected")
+
+	assert.True(IsRetryable(err))
+	assert.False(IsRetryable(Permanent(err)))
+	assert.ErrorIs(Permanent(err), err)
+}
+
+func TestRetrier(t *testing.T) {
+	ctx := context.Background()
+	policy := RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Minute,
+		Multiplier:     2,
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the command is sent again", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := &failingPublisher{
+				InMemoryPublisher: NewInMemoryPublisher(),
+				typ:               "CreatePaymentCommand",
+				failures:          1,
+				err:               errors.New("broker unavailable"),
+			}
+			sec := NewExecutionCoordinator(store, pub, newRetrySagaDefinition(t, policy))
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			assert.EqualError(sec.ForwardFlow(ctx, *saga), "broker unavailable")
+
+			found, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			step, err := found.GetStep("create-payment")
+			require.Nil(t, err)
+			assert.Equal(StepStatusPending, step.Status)
+			assert.Equal(1, step.Attempts)
+			require.NotNil(t, step.NextRetry)
+			nextRetry := *step.NextRetry
+
+			retrier := sec.Retrier()
+			retrier.now = func() time.Time { return nextRetry.Add(-time.Second) }
+
+			// Then nothing is retried before the backoff.
+			n, err := retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+
+			retrier.now = func() time.Time { return nextRetry }
+			n, err = retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+			assert.Len(pub.Commands(), 1)
+			// With the message id of the attempt that failed.
+			assert.Equal(step.RequestMetadata.MessageID, pub.Commands()[0].MessageID)
+
+			found, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			step, err = found.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Nil(step.NextRetry)
+
+			// And the attempts are reset by the event.
+			saga, err = sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+			assert.Nil(err)
+			step, err = saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal(0, step.Attempts)
+		})
+
+		t.Run("when the attempts are exhausted", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := &failingPublisher{
+				InMemoryPublisher: NewInMemoryPublisher(),
+				typ:               "CreatePaymentCommand",
+				failures:          -1,
+				err:               errors.New("broker unavailable"),
+			}
+			sec := NewExecutionCoordinator(store, pub, newRetrySagaDefinition(t, policy))
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			assert.NotNil(sec.ForwardFlow(ctx, *saga))
+
+			retrier := sec.Retrier()
+			retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+			n, err := retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the step fails, and the saga is compensated.
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			step, err := found.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal(StepStatusFailed, step.Status)
+			assert.Equal(2, step.Attempts)
+			assert.Nil(step.NextRetry)
+
+			commands := pub.Commands()
+			assert.Len(commands, 1)
+			assert.Equal("CancelBookingCommand", commands[0].Type)
+
+			n, err = retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+		})
+
+		t.Run("when the error is permanent", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := &failingPublisher{
+				InMemoryPublisher: NewInMemoryPublisher(),
+				typ:               "CreatePaymentCommand",
+				failures:          -1,
+				err:               Permanent(errors.New("invalid command")),
+			}
+			sec := NewExecutionCoordinator(store, pub, newRetrySagaDefinition(t, policy))
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			assert.Nil(sec.ForwardFlow(ctx, *saga))
+
+			// Then the step fails without being retried.
+			found, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			step, err := found.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal(StepStatusFailed, step.Status)
+			assert.Equal(1, step.Attempts)
+			assert.Equal(SagaStatusCompensating, found.CheckStatus())
+		})
+	})
+
+	t.Run("when the step has no retry policy", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := &failingPublisher{
+			InMemoryPublisher: NewInMemoryPublisher(),
+			typ:               "CreatePaymentCommand",
+			failures:          1,
+			err:               errors.New("broker unavailable"),
+		}
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		assert.NotNil(sec.ForwardFlow(ctx, *saga))
+
+		// Then the command is due to be sent again.
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err := found.GetStep("create-payment")
+		assert.Nil(err)
+		assert.Equal(StepStatusPending, step.Status)
+		assert.Equal(1, step.Attempts)
+		assert.NotNil(step.NextRetry)
+
+		// And the next flow sends it.
+		assert.Nil(sec.ForwardFlow(ctx, found))
+		commands := pub.Commands()
+		require.Len(t, commands, 1)
+		assert.Equal(step.RequestMetadata.MessageID, commands[0].MessageID)
+
+		found, err = store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err = found.GetStep("create-payment")
+		assert.Nil(err)
+		assert.Nil(step.NextRetry)
+	})
+
+	t.Run("when replaying the log", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewLogStore(NewSQLLog(newSQLStore(t).db))
+		pub := &failingPublisher{
+			InMemoryPublisher: NewInMemoryPublisher(),
+			typ:               "CreatePaymentCommand",
+			failures:          -1,
+			err:               errors.New("broker unavailable"),
+		}
+		sec := NewExecutionCoordinator(store, pub, newRetrySagaDefinition(t, policy))
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		assert.NotNil(sec.ForwardFlow(ctx, *saga))
+
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err := found.GetStep("create-payment")
+		assert.Nil(err)
+		assert.Equal(1, step.Attempts)
+		assert.NotNil(step.NextRetry)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// ErrUnhandledEvent is returned when no handler is registered for the event.
+var ErrUnhandledEvent = errors.New("unhandled event")
+
+type EventHandler func(ctx context.Context, evt event) (*Saga, error)
+
+// EventRouter dispatches events to the handler registered for their type.
+type EventRouter struct {
+	handlers map[reflect.Type]EventHandler
+}
+
+func NewEventRouter() *EventRouter {
+	return &EventRouter{
+		handlers: make(map[reflect.Type]EventHandler),
+	}
+}
+
+// Handle registers the handler for the type of the event. Values and pointers
+// of the same type are dispatched to the same handler. It panics if the type
+// already has a handler.
+func (r *EventRouter) Handle(evt event, h EventHandler) *EventRouter {
+	typ := eventType(evt)
+	if _, ok := r.handlers[typ]; ok {
+		panic(fmt.Sprintf("event %s registered twice", typ))
+	}
+	r.handlers[typ] = h
+	return r
+}
+
+// Route dispatches the event to its handler.
+func (r *EventRouter) Route(ctx context.Context, evt event) (*Saga, error) {
+	h, ok := r.handlers[eventType(evt)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnhandledEvent, evt)
+	}
+	return h(ctx, evt)
+}
+
+// Run routes the events and sends the resulting sagas, until the events
+// channel is closed or the context is done. Events that fail are logged and
+// skipped.
+func (r *EventRouter) Run(ctx context.Context, events <-chan event, sagas chan<- *Saga) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case evt, ok := <-events:
+			if !ok {
+				return nil
+			}
+			saga, err := r.Route(ctx, evt)
+			if err != nil {
+				log.Printf("failed to handle event %T: %s\n", evt, err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case sagas <- saga:
+			}
+		}
+	}
+}
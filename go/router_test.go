@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventRouter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when routing values and pointers", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var routed []event
+		r := NewEventRouter().Handle(PaymentCreated{}, func(ctx context.Context, evt event) (*Saga, error) {
+			routed = append(routed, evt)
+			return &Saga{ID: evt.sagaID()}, nil
+		})
+
+		_, err := r.Route(ctx, PaymentCreated{ID: "1"})
+		assert.Nil(err)
+		_, err = r.Route(ctx, &PaymentCreated{ID: "2"})
+		assert.Nil(err)
+		assert.Len(routed, 2)
+	})
+
+	t.Run("when event is not registered", func(t *testing.T) {
+		_, err := NewEventRouter().Route(ctx, PaymentCreated{ID: "1"})
+		assert.ErrorIs(t, err, ErrUnhandledEvent)
+	})
+
+	t.Run("when event is registered twice", func(t *testing.T) {
+		r := NewEventRouter().Handle(PaymentCreated{}, nil)
+		assert.Panics(t, func() {
+			r.Handle(&PaymentCreated{}, nil)
+		})
+	})
+}
+
+// runChannels drives the saga through channels, with the participants
+// replying to each command with the event returned by reply.
+func runChannels(t *testing.T, store repository, reply func(cmd CommandEnvelope) event, start event) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	evtCh := make(chan event, 10)
+	sagaCh := make(chan *Saga, 10)
+
+	pub := PublisherFunc(func(ctx context.Context, cmd CommandEnvelope) error {
+		if evt := reply(cmd); evt != nil {
+			evtCh <- evt
+		}
+		return nil
+	})
+	sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = sec.Router().Run(ctx, evtCh, sagaCh)
+	}()
+	go func() {
+		defer wg.Done()
+		_ = sec.RunFlows(ctx, sagaCh)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	evtCh <- start
+}
+
+func TestEventRouter_Channels(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when saga completes", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		runChannels(t, store, func(cmd CommandEnvelope) event {
+			switch cmd.Type {
+			case "CreatePaymentCommand":
+				return &PaymentCreated{ID: cmd.CorrelationID}
+			case "ConfirmBookingCommand":
+				return BookingConfirmed{ID: cmd.CorrelationID}
+			}
+			return nil
+		}, BookingCreated{ID: "1"})
+
+		assert.Eventually(func() bool {
+			saga, err := store.FindSaga(ctx, "1")
+			return err == nil && saga.Status == SagaStatusCompleted
+		}, time.Second, time.Millisecond)
+
+		saga, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		for _, step := range saga.Steps {
+			assert.Equal(StepStatusSuccess, step.Status)
+		}
+	})
+
+	t.Run("when payment fails", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+
+		runChannels(t, store, func(cmd CommandEnvelope) event {
+			switch cmd.Type {
+			case "CreatePaymentCommand":
+				return PaymentFailed{ID: cmd.CorrelationID}
+			case "CancelBookingCommand":
+				return &BookingCancelled{ID: cmd.CorrelationID}
+			}
+			return nil
+		}, &BookingCreated{ID: "1"})
+
+		assert.Eventually(func() bool {
+			saga, err := store.FindSaga(ctx, "1")
+			return err == nil && saga.Status == SagaStatusCompensated
+		}, time.Second, time.Millisecond)
+
+		saga, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		step, err := saga.GetStep("create-booking")
+		assert.Nil(err)
+		assert.Equal(StepStatusCompensated, step.Status)
+	})
+}
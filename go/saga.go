@@ -1,53 +1,137 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 type Saga struct {
 	ID      string
 	Name    string
 	Version uint
-	Status  string
+	Status  SagaStatus
 	Steps   []Step
-	Payload []byte
+
+	// Payload is the input of the saga, encoded with the codec named
+	// PayloadCodec, in the version PayloadSchemaVersion of its schema.
+	Payload              []byte
+	PayloadCodec         string
+	PayloadSchemaVersion int
+
+	// Revision is incremented on every update, and is used to detect
+	// concurrent modification of the same saga.
+	Revision uint
+
+	// changes are the log records of the changes made since the saga was
+	// loaded.
+	changes []LogRecord
+
+	// commands are the commands to be written to the outbox.
+	commands []CommandEnvelope
+
+	// processed is the id of the message applied to the saga, to be
+	// recorded as processed with the next update.
+	processed string
 }
 
-func NewBookingSaga(id string) *Saga {
-	return &Saga{
-		ID:      id,
-		Name:    "booking-saga",
-		Version: 1,
-		Status:  "pending",
-		Steps: []Step{
-			{Name: "create-booking", Status: "pending"},
-			{Name: "create-payment", Status: "pending"},
-			{Name: "confirm-booking", Status: "pending"},
-		},
+// CheckStatus derives the status from the children steps. The saga is rolled
+// back as soon as a step has failed or been compensated, and the rollback is
+// over once no step is left successful or waiting for its event. The order of
+// the steps does not matter, so that steps running in parallel are accounted
+// for.
+//
+// A group of parallel steps succeeds once Required of its steps have
+// succeeded, and fails only once Required can no longer be reached. Skipped
+// steps count as succeeded, but have nothing to undo.
+func (s *Saga) CheckStatus() SagaStatus {
+	type unit struct {
+		size, required, success, failed int
 	}
-}
+	var units []*unit
+	groups := make(map[string]*unit)
 
-// CheckStatus derives the status from the children steps.
-func (s *Saga) CheckStatus() string {
-	for i, step := range s.Steps {
-		// If any step fails, then it is compensating.
-		if step.Status == "failed" {
-			return "compensating"
+	var success, awaiting, compensated int
+	for _, step := range s.Steps {
+		u, ok := groups[step.Group]
+		if !ok {
+			u = &unit{required: step.Required}
+			units = append(units, u)
+			if step.Group != "" {
+				groups[step.Group] = u
+			}
 		}
+		u.size++
 
-		// If the last step is a success.
-		if step.Status == "success" {
-			if i == len(s.Steps)-1 {
-				return "done"
-			}
+		switch step.Status {
+		case StepStatusSuccess:
+			success++
+			u.success++
+		case StepStatusFailed:
+			u.failed++
+		case StepStatusCompensated:
+			compensated++
+		case StepStatusSkipped:
+			u.success++
 		}
-		// If the first step has been compensated.
-		if step.Status == "compensated" {
-			if i == 0 {
-				return "done"
-			}
-			return "compensating"
+		if step.awaiting() {
+			awaiting++
 		}
 	}
-	return "pending"
+
+	var done, failed int
+	for _, u := range units {
+		required := u.required
+		if required <= 0 {
+			required = u.size
+		}
+		if u.success >= required {
+			done++
+		}
+		if u.failed > u.size-required {
+			failed++
+		}
+	}
+
+	rollback := failed > 0 || compensated > 0
+	switch {
+	case rollback && success+awaiting > 0:
+		return SagaStatusCompensating
+	case compensated > 0:
+		return SagaStatusCompensated
+	case rollback:
+		return SagaStatusFailed
+	case done == len(units):
+		return SagaStatusCompleted
+	default:
+		return SagaStatusPending
+	}
+}
+
+// transition moves the saga to the given status, and records the change. It
+// returns an error if the saga cannot move to the status.
+func (s *Saga) transition(to SagaStatus) error {
+	if s.Status == to {
+		return nil
+	}
+	if !s.Status.CanTransitionTo(to) {
+		return fmt.Errorf("saga %q cannot move from status %s to %s", s.ID, s.Status, to)
+	}
+	s.Status = to
+	s.record(LogRecord{
+		Type:       LogRecordStatus,
+		SagaStatus: to,
+	})
+	return nil
+}
+
+// syncStatus moves the saga to the status derived from its steps. A stuck
+// saga stays stuck while it is compensating.
+func (s *Saga) syncStatus() error {
+	status := s.CheckStatus()
+	if s.Status == SagaStatusStuck && status == SagaStatusCompensating {
+		return nil
+	}
+	return s.transition(status)
 }
 
 func (s *Saga) GetStep(name string) (Step, error) {
@@ -68,3 +152,93 @@ func (s *Saga) UpdateStep(step Step) error {
 	}
 	return errors.New("step not found")
 }
+
+// InsertStep inserts the step after the step with the given name, or first if
+// the name is empty.
+func (s *Saga) InsertStep(after string, step Step) error {
+	i := 0
+	if after != "" {
+		i = -1
+		for j, ss := range s.Steps {
+			if ss.Name == after {
+				i = j + 1
+				break
+			}
+		}
+		if i < 0 {
+			return errors.New("step not found")
+		}
+	}
+	s.Steps = append(s.Steps, Step{})
+	copy(s.Steps[i+1:], s.Steps[i:])
+	s.Steps[i] = step
+	return nil
+}
+
+// DecodePayload decodes the input of the saga, the payload of the event that
+// started it, into v.
+func (s *Saga) DecodePayload(v interface{}) error {
+	if s.Payload == nil {
+		return fmt.Errorf("saga %q has no payload", s.ID)
+	}
+	return unmarshal(s.PayloadCodec, s.Payload, v)
+}
+
+// DecodeResponse decodes the response of the step with the given name into v.
+func (s *Saga) DecodeResponse(name string, v interface{}) error {
+	step, err := s.GetStep(name)
+	if err != nil {
+		return err
+	}
+	return step.DecodeResponse(v)
+}
+
+// lastMessage returns the metadata of the most recent event applied to the
+// saga.
+func (s *Saga) lastMessage() Metadata {
+	var last Metadata
+	for _, step := range s.Steps {
+		if step.ResponseMetadata.Timestamp.After(last.Timestamp) {
+			last = step.ResponseMetadata
+		}
+	}
+	return last
+}
+
+// Validate rejects sagas with unknown statuses, which would otherwise never
+// match any transition and stall silently.
+func (s *Saga) Validate() error {
+	if !s.Status.Valid() {
+		return fmt.Errorf("saga %q has invalid status: %q", s.ID, s.Status)
+	}
+	for _, step := range s.Steps {
+		if !step.Status.Valid() {
+			return fmt.Errorf("saga %q step %q has invalid status: %q", s.ID, step.Name, step.Status)
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of the saga, without the recorded changes,
+// commands and processed message.
+func (s *Saga) clone() Saga {
+	cp := *s
+	cp.changes = nil
+	cp.commands = nil
+	cp.processed = ""
+	cp.Payload = cloneBytes(s.Payload)
+	if s.Steps != nil {
+		cp.Steps = make([]Step, len(s.Steps))
+		for i, step := range s.Steps {
+			cp.Steps[i] = step.clone()
+		}
+	}
+	return cp
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,13 +14,13 @@ func TestSaga(t *testing.T) {
 			Name:    "booking-saga",
 			Version: 1,
 			Steps: []Step{
-				{Name: "create-booking", Status: "pending"},
-				{Name: "create-payment", Status: "pending"},
-				{Name: "confirm-booking", Status: "pending"},
+				{Name: "create-booking", Status: StepStatusPending},
+				{Name: "create-payment", Status: StepStatusPending},
+				{Name: "confirm-booking", Status: StepStatusPending},
 			},
 		}
 
-		assert.Equal(t, "pending", saga.CheckStatus())
+		assert.Equal(t, SagaStatusPending, saga.CheckStatus())
 	})
 
 	t.Run("when one step failed", func(t *testing.T) {
@@ -28,13 +29,13 @@ func TestSaga(t *testing.T) {
 			Name:    "booking-saga",
 			Version: 1,
 			Steps: []Step{
-				{Name: "create-booking", Status: "success"},
-				{Name: "create-payment", Status: "failed"},
-				{Name: "confirm-booking", Status: "pending"},
+				{Name: "create-booking", Status: StepStatusSuccess},
+				{Name: "create-payment", Status: StepStatusFailed},
+				{Name: "confirm-booking", Status: StepStatusPending},
 			},
 		}
 
-		assert.Equal(t, "compensating", saga.CheckStatus())
+		assert.Equal(t, SagaStatusCompensating, saga.CheckStatus())
 	})
 
 	t.Run("when all steps completed", func(t *testing.T) {
@@ -43,13 +44,13 @@ func TestSaga(t *testing.T) {
 			Name:    "booking-saga",
 			Version: 1,
 			Steps: []Step{
-				{Name: "create-booking", Status: "success"},
-				{Name: "create-payment", Status: "success"},
-				{Name: "confirm-booking", Status: "success"},
+				{Name: "create-booking", Status: StepStatusSuccess},
+				{Name: "create-payment", Status: StepStatusSuccess},
+				{Name: "confirm-booking", Status: StepStatusSuccess},
 			},
 		}
 
-		assert.Equal(t, "done", saga.CheckStatus())
+		assert.Equal(t, SagaStatusCompleted, saga.CheckStatus())
 	})
 
 	t.Run("when all steps compensated", func(t *testing.T) {
@@ -58,13 +59,13 @@ func TestSaga(t *testing.T) {
 			Name:    "booking-saga",
 			Version: 1,
 			Steps: []Step{
-				{Name: "create-booking", Status: "compensated"},
-				{Name: "create-payment", Status: "compensated"},
-				{Name: "confirm-booking", Status: "failed"},
+				{Name: "create-booking", Status: StepStatusCompensated},
+				{Name: "create-payment", Status: StepStatusCompensated},
+				{Name: "confirm-booking", Status: StepStatusFailed},
 			},
 		}
 
-		assert.Equal(t, "done", saga.CheckStatus())
+		assert.Equal(t, SagaStatusCompensated, saga.CheckStatus())
 	})
 
 	t.Run("when second step failed and first step is compensated", func(t *testing.T) {
@@ -74,12 +75,180 @@ func TestSaga(t *testing.T) {
 			Name:    "booking-saga",
 			Version: 1,
 			Steps: []Step{
-				{Name: "create-booking", Status: "compensated"},
-				{Name: "create-payment", Status: "failed"},
-				{Name: "confirm-booking", Status: "pending"},
+				{Name: "create-booking", Status: StepStatusCompensated},
+				{Name: "create-payment", Status: StepStatusFailed},
+				{Name: "confirm-booking", Status: StepStatusPending},
 			},
 		}
 
-		assert.Equal(t, "done", saga.CheckStatus())
+		assert.Equal(t, SagaStatusCompensated, saga.CheckStatus())
 	})
 }
+
+// TestSaga_CheckStatus enumerates every combination of step statuses, and
+// checks the derived status against the properties it must satisfy.
+func TestSaga_CheckStatus(t *testing.T) {
+	statuses := []StepStatus{
+		StepStatusPending,
+		StepStatusSuccess,
+		StepStatusFailed,
+		StepStatusCompensated,
+		StepStatusSkipped,
+	}
+
+	var combinations func(n int) [][]StepStatus
+	combinations = func(n int) [][]StepStatus {
+		if n == 0 {
+			return [][]StepStatus{{}}
+		}
+		var result [][]StepStatus
+		for _, c := range combinations(n - 1) {
+			for _, status := range statuses {
+				result = append(result, append(append([]StepStatus{}, c...), status))
+			}
+		}
+		return result
+	}
+
+	for n := 1; n <= 5; n++ {
+		for _, c := range combinations(n) {
+			saga := &Saga{ID: "1"}
+			reversed := &Saga{ID: "1"}
+			count := make(map[StepStatus]int)
+			for i, status := range c {
+				saga.Steps = append(saga.Steps, Step{Name: fmt.Sprint(i), Status: status})
+				reversed.Steps = append([]Step{{Name: fmt.Sprint(i), Status: status}}, reversed.Steps...)
+				count[status]++
+			}
+			status := saga.CheckStatus()
+			rollback := count[StepStatusFailed] > 0 || count[StepStatusCompensated] > 0
+			done := count[StepStatusSuccess] + count[StepStatusSkipped]
+
+			assert.True(t, status.Valid(), c)
+			assert.Equal(t, status, reversed.CheckStatus(), "order matters for %v", c)
+			assert.Equal(t, done == n, status == SagaStatusCompleted, c)
+			assert.Equal(t, !rollback && done < n, status == SagaStatusPending, c)
+			assert.Equal(t, rollback && count[StepStatusSuccess] > 0, status == SagaStatusCompensating, c)
+			assert.Equal(t, rollback && count[StepStatusSuccess] == 0 && count[StepStatusCompensated] > 0, status == SagaStatusCompensated, c)
+			assert.Equal(t, count[StepStatusFailed] > 0 && count[StepStatusSuccess] == 0 && count[StepStatusCompensated] == 0, status == SagaStatusFailed, c)
+			assert.NotEqual(t, SagaStatusStuck, status, c)
+		}
+	}
+}
+
+func TestSaga_CheckStatus_Group(t *testing.T) {
+	group := func(required int, statuses ...StepStatus) *Saga {
+		saga := &Saga{
+			ID:    "1",
+			Steps: []Step{{Name: "create-trip", Status: StepStatusSuccess}},
+		}
+		for i, status := range statuses {
+			saga.Steps = append(saga.Steps, Step{
+				Name:     fmt.Sprint(i),
+				Status:   status,
+				Group:    "reserve",
+				Required: required,
+			})
+		}
+		return saga
+	}
+
+	assert := assert.New(t)
+	assert.Equal(SagaStatusPending, group(0, StepStatusSuccess, StepStatusSuccess, StepStatusPending).CheckStatus())
+	assert.Equal(SagaStatusCompleted, group(0, StepStatusSuccess, StepStatusSuccess, StepStatusSuccess).CheckStatus())
+	assert.Equal(SagaStatusCompensating, group(0, StepStatusSuccess, StepStatusFailed, StepStatusPending).CheckStatus())
+	assert.Equal(SagaStatusCompleted, group(2, StepStatusSuccess, StepStatusSuccess, StepStatusFailed).CheckStatus())
+	assert.Equal(SagaStatusPending, group(2, StepStatusSuccess, StepStatusFailed, StepStatusPending).CheckStatus())
+	assert.Equal(SagaStatusCompensating, group(2, StepStatusSuccess, StepStatusFailed, StepStatusFailed).CheckStatus())
+	assert.Equal(SagaStatusCompleted, group(0, StepStatusSuccess, StepStatusSkipped, StepStatusSuccess).CheckStatus())
+	assert.Equal(SagaStatusPending, group(2, StepStatusSkipped, StepStatusFailed, StepStatusPending).CheckStatus())
+
+	// A step that is waiting for its event may still succeed, and need to be
+	// compensated.
+	saga := group(0, StepStatusCompensated, StepStatusFailed, StepStatusPending)
+	saga.Steps[0].Status = StepStatusCompensated
+	assert.Equal(SagaStatusCompensated, saga.CheckStatus())
+	saga.Steps[3].RequestPayload = []byte("{}")
+	assert.Equal(SagaStatusCompensating, saga.CheckStatus())
+}
+
+func TestSaga_transition(t *testing.T) {
+	t.Run("when the transition is valid", func(t *testing.T) {
+		assert := assert.New(t)
+		saga := &Saga{ID: "1", Status: SagaStatusPending}
+
+		assert.Nil(saga.transition(SagaStatusCompensating))
+		assert.Nil(saga.transition(SagaStatusStuck))
+		assert.Nil(saga.transition(SagaStatusCompensated))
+		assert.Equal(SagaStatusCompensated, saga.Status)
+		assert.Len(saga.changes, 3)
+	})
+
+	t.Run("when the saga is terminal", func(t *testing.T) {
+		for _, status := range []SagaStatus{SagaStatusCompleted, SagaStatusCompensated, SagaStatusFailed} {
+			saga := &Saga{ID: "1", Status: status}
+			assert.True(t, status.Terminal())
+			assert.NotNil(t, saga.transition(SagaStatusPending))
+			assert.NotNil(t, saga.transition(SagaStatusCompensating))
+			assert.Equal(t, status, saga.Status)
+		}
+	})
+
+	t.Run("when a completed saga fails afterwards", func(t *testing.T) {
+		assert := assert.New(t)
+		saga := &Saga{
+			ID:     "1",
+			Status: SagaStatusCompleted,
+			Steps: []Step{
+				{Name: "create-booking", Status: StepStatusSuccess},
+				{Name: "confirm-booking", Status: StepStatusFailed},
+			},
+		}
+
+		// Then it is not compensated.
+		assert.NotNil(saga.syncStatus())
+		assert.Equal(SagaStatusCompleted, saga.Status)
+	})
+
+	t.Run("when the saga is stuck", func(t *testing.T) {
+		assert := assert.New(t)
+		saga := &Saga{
+			ID:     "1",
+			Status: SagaStatusStuck,
+			Steps: []Step{
+				{Name: "create-booking", Status: StepStatusSuccess},
+				{Name: "create-payment", Status: StepStatusFailed},
+			},
+		}
+
+		// Then it stays stuck while it is compensating.
+		assert.Nil(saga.syncStatus())
+		assert.Equal(SagaStatusStuck, saga.Status)
+	})
+}
+
+func TestSaga_Decode(t *testing.T) {
+	assert := assert.New(t)
+	saga := &Saga{
+		ID:      "1",
+		Payload: []byte(`{"ID":"1","Amount":100}`),
+		Steps: []Step{
+			{Name: "create-booking", Status: StepStatusSuccess, ResponsePayload: []byte(`{"ID":"1"}`)},
+			{Name: "create-payment", Status: StepStatusPending},
+		},
+	}
+
+	var booking BookingCreated
+	assert.Nil(saga.DecodePayload(&booking))
+	assert.Equal(100, booking.Amount)
+
+	var created BookingCreated
+	assert.Nil(saga.DecodeResponse("create-booking", &created))
+	assert.Equal("1", created.ID)
+
+	// Then steps without a response cannot be decoded.
+	var payment PaymentCreated
+	assert.NotNil(saga.DecodeResponse("create-payment", &payment))
+	assert.NotNil(saga.DecodeResponse("confirm-booking", &payment))
+	assert.NotNil((&Saga{ID: "2"}).DecodePayload(&booking))
+}
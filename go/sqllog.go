@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+const findLastLogRecord = `
+	SELECT COALESCE(MAX(sequence), 0), COALESCE(MAX(revision), 0)
+	FROM saga_log
+	WHERE saga_id = $1
+`
+
+const insertLogRecord = `
+	INSERT INTO saga_log (saga_id, sequence, revision, type, step, name, step_status, saga_status, metadata, deadline, attempts, next_retry, error, payload, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+`
+
+const findLogRecords = `
+	SELECT saga_id, sequence, revision, type, step, name, step_status, saga_status, metadata, deadline, attempts, next_retry, error, payload, created_at
+	FROM saga_log
+	WHERE saga_id = $1 AND revision > $2
+	ORDER BY sequence
+`
+
+const findSnapshot = `
+	SELECT state
+	FROM saga_snapshot
+	WHERE saga_id = $1
+`
+
+const upsertSnapshot = `
+	INSERT INTO saga_snapshot (saga_id, revision, state)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (saga_id) DO UPDATE SET revision = excluded.revision, state = excluded.state
+	WHERE excluded.revision > saga_snapshot.revision
+`
+
+// SQLLog is a SagaLog stored in the saga_log table created by
+// SQLStore.Migrate. Concurrent appends at the same revision are rejected by the
+// primary key on the sequence.
+type SQLLog struct {
+	db *sql.DB
+}
+
+func NewSQLLog(db *sql.DB) *SQLLog {
+	return &SQLLog{
+		db: db,
+	}
+}
+
+func (l *SQLLog) Append(ctx context.Context, sagaID string, revision uint, records []LogRecord) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sequence, last, err := findLastLogRecordTx(ctx, tx, sagaID)
+	if err != nil {
+		return err
+	}
+	if last != revision {
+		return ErrConcurrentModification
+	}
+	if err := insertLogRecordsTx(ctx, tx, sagaID, sequence, records); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// findLastLogRecordTx returns the sequence and the revision of the last record
+// of the saga, or zeros if the saga has no records.
+func findLastLogRecordTx(ctx context.Context, tx *sql.Tx, sagaID string) (sequence, revision uint, err error) {
+	err = tx.QueryRowContext(ctx, findLastLogRecord, sagaID).Scan(&sequence, &revision)
+	return sequence, revision, err
+}
+
+// insertLogRecordsTx appends the records after the record at the given
+// sequence.
+func insertLogRecordsTx(ctx context.Context, tx *sql.Tx, sagaID string, sequence uint, records []LogRecord) error {
+	for _, rec := range records {
+		sequence++
+		if _, err := tx.ExecContext(ctx, insertLogRecord,
+			sagaID,
+			sequence,
+			rec.Revision,
+			rec.Type,
+			rec.Step,
+			rec.Name,
+			rec.StepStatus,
+			rec.SagaStatus,
+			rec.Metadata,
+			utcTime(rec.Deadline),
+			rec.Attempts,
+			utcTime(rec.NextRetry),
+			rec.Error,
+			rec.Payload,
+			rec.CreatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *SQLLog) Read(ctx context.Context, sagaID string, revision uint) ([]LogRecord, error) {
+	rows, err := l.db.QueryContext(ctx, findLogRecords, sagaID, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []LogRecord
+	for rows.Next() {
+		var rec LogRecord
+		if err := rows.Scan(
+			&rec.SagaID,
+			&rec.Sequence,
+			&rec.Revision,
+			&rec.Type,
+			&rec.Step,
+			&rec.Name,
+			&rec.StepStatus,
+			&rec.SagaStatus,
+			&rec.Metadata,
+			&rec.Deadline,
+			&rec.Attempts,
+			&rec.NextRetry,
+			&rec.Error,
+			&rec.Payload,
+			&rec.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// SQLSnapshots is a Snapshots stored in the saga_snapshot table created by
+// SQLStore.Migrate, so that snapshots survive a restart.
+type SQLSnapshots struct {
+	db *sql.DB
+}
+
+func NewSQLSnapshots(db *sql.DB) *SQLSnapshots {
+	return &SQLSnapshots{
+		db: db,
+	}
+}
+
+func (s *SQLSnapshots) SaveSnapshot(ctx context.Context, saga Saga) error {
+	b, err := json.Marshal(saga)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, upsertSnapshot, saga.ID, saga.Revision, b)
+	return err
+}
+
+func (s *SQLSnapshots) FindSnapshot(ctx context.Context, id string) (Saga, error) {
+	var b []byte
+	err := s.db.QueryRowContext(ctx, findSnapshot, id).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Saga{}, nil
+	}
+	if err != nil {
+		return Saga{}, err
+	}
+	var saga Saga
+	if err := json.Unmarshal(b, &saga); err != nil {
+		return Saga{}, err
+	}
+	return saga, nil
+}
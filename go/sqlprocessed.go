@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const findProcessedMessage = `
+	SELECT EXISTS (
+		SELECT 1 FROM saga_processed_message
+		WHERE message_id = $1 AND processed_at >= $2
+	)
+`
+
+const insertProcessedMessage = `
+	INSERT INTO saga_processed_message (message_id, processed_at)
+	VALUES ($1, $2)
+	ON CONFLICT (message_id) DO UPDATE SET processed_at = excluded.processed_at
+`
+
+const claimProcessedMessage = `
+	INSERT INTO saga_processed_message (message_id, processed_at)
+	VALUES ($1, $2)
+	ON CONFLICT (message_id) DO UPDATE SET processed_at = excluded.processed_at
+	WHERE saga_processed_message.processed_at < $3
+`
+
+const deleteProcessedMessages = `
+	DELETE FROM saga_processed_message
+	WHERE processed_at < $1
+`
+
+// SQLProcessedMessages is a ProcessedMessages stored in the
+// saga_processed_message table created by SQLStore.Migrate.
+type SQLProcessedMessages struct {
+	db        *sql.DB
+	retention time.Duration
+	now       func() time.Time
+}
+
+func NewSQLProcessedMessages(db *sql.DB) *SQLProcessedMessages {
+	return &SQLProcessedMessages{
+		db:        db,
+		retention: DefaultRetention,
+		now:       time.Now,
+	}
+}
+
+// WithRetention sets how long processed messages are remembered.
+func (p *SQLProcessedMessages) WithRetention(retention time.Duration) *SQLProcessedMessages {
+	p.retention = retention
+	return p
+}
+
+func (p *SQLProcessedMessages) Processed(ctx context.Context, messageID string) (bool, error) {
+	var processed bool
+	err := p.db.QueryRowContext(ctx, findProcessedMessage, messageID, p.expiry()).Scan(&processed)
+	return processed, err
+}
+
+func (p *SQLProcessedMessages) MarkProcessed(ctx context.Context, messageID string) error {
+	_, err := p.db.ExecContext(ctx, insertProcessedMessage, messageID, p.now().UTC())
+	return err
+}
+
+// claimTx records the message in the transaction, and returns
+// ErrDuplicateMessage if it was processed within the retention.
+func (p *SQLProcessedMessages) claimTx(ctx context.Context, tx *sql.Tx, messageID string) error {
+	res, err := tx.ExecContext(ctx, claimProcessedMessage, messageID, p.now().UTC(), p.expiry())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
+}
+
+func (p *SQLProcessedMessages) Purge(ctx context.Context) (int, error) {
+	res, err := p.db.ExecContext(ctx, deleteProcessedMessages, p.expiry())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// expiry returns the time before which processed messages are forgotten. Times
+// are stored in UTC so that they compare in order.
+func (p *SQLProcessedMessages) expiry() time.Time {
+	return p.now().Add(-p.retention).UTC()
+}
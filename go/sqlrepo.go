@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sqlMigrations are applied in order, and each is applied only once. Append
+// new migrations to the end, never edit the existing ones.
+var sqlMigrations = []string{
+	`CREATE TABLE saga (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		payload BLOB,
+		revision INTEGER NOT NULL
+	);
+	CREATE TABLE saga_step (
+		saga_id TEXT NOT NULL REFERENCES saga (id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		request_payload BLOB,
+		response_payload BLOB,
+		PRIMARY KEY (saga_id, position),
+		UNIQUE (saga_id, name)
+	);`,
+	`CREATE TABLE saga_log (
+		saga_id TEXT NOT NULL,
+		sequence INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		step TEXT NOT NULL,
+		name TEXT NOT NULL,
+		step_status TEXT NOT NULL,
+		saga_status TEXT NOT NULL,
+		payload BLOB,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (saga_id, sequence)
+	);`,
+	`CREATE TABLE saga_outbox (
+		id INTEGER PRIMARY KEY,
+		saga_id TEXT NOT NULL,
+		step TEXT NOT NULL,
+		type TEXT NOT NULL,
+		payload BLOB,
+		created_at TIMESTAMP NOT NULL,
+		dispatched_at TIMESTAMP
+	);
+	CREATE INDEX saga_outbox_pending_idx ON saga_outbox (id) WHERE dispatched_at IS NULL;`,
+	`ALTER TABLE saga_step ADD COLUMN response_metadata BLOB;
+	ALTER TABLE saga_log ADD COLUMN metadata BLOB;
+	ALTER TABLE saga_outbox ADD COLUMN metadata BLOB;`,
+	`CREATE TABLE saga_processed_message (
+		message_id TEXT PRIMARY KEY,
+		processed_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX saga_processed_message_processed_at_idx ON saga_processed_message (processed_at);`,
+	`ALTER TABLE saga_step ADD COLUMN deadline TIMESTAMP;
+	ALTER TABLE saga_log ADD COLUMN deadline TIMESTAMP;
+	CREATE INDEX saga_step_deadline_idx ON saga_step (deadline) WHERE deadline IS NOT NULL;`,
+	`ALTER TABLE saga_step ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE saga_step ADD COLUMN next_retry TIMESTAMP;
+	ALTER TABLE saga_log ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE saga_log ADD COLUMN next_retry TIMESTAMP;
+	CREATE INDEX saga_step_next_retry_idx ON saga_step (next_retry) WHERE next_retry IS NOT NULL;`,
+	`ALTER TABLE saga_step ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+	ALTER TABLE saga_log ADD COLUMN error TEXT NOT NULL DEFAULT '';
+	CREATE INDEX saga_status_idx ON saga (status);`,
+	`UPDATE saga
+	SET status = CASE
+		WHEN EXISTS (SELECT 1 FROM saga_step WHERE saga_id = saga.id AND status = 'compensated') THEN 'compensated'
+		ELSE 'completed'
+	END
+	WHERE status = 'done';
+	UPDATE saga_log
+	SET saga_status = CASE
+		WHEN EXISTS (SELECT 1 FROM saga_log l WHERE l.saga_id = saga_log.saga_id AND l.step_status = 'compensated') THEN 'compensated'
+		ELSE 'completed'
+	END
+	WHERE saga_status = 'done';`,
+	`ALTER TABLE saga_step ADD COLUMN group_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE saga_step ADD COLUMN required INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE saga_step ADD COLUMN request_metadata BLOB;`,
+	`ALTER TABLE saga ADD COLUMN payload_codec TEXT NOT NULL DEFAULT '';
+	ALTER TABLE saga ADD COLUMN payload_schema_version INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE saga_snapshot (
+		saga_id TEXT PRIMARY KEY,
+		revision INTEGER NOT NULL,
+		state BLOB NOT NULL
+	);`,
+	`ALTER TABLE saga_outbox ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE saga_outbox ADD COLUMN next_attempt TIMESTAMP;
+	ALTER TABLE saga_outbox ADD COLUMN last_error TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE saga_outbox ADD COLUMN compensation INTEGER NOT NULL DEFAULT 0;`,
+	`UPDATE saga
+	SET status = 'compensating'
+	WHERE status = 'compensated' AND EXISTS (
+		SELECT 1 FROM saga_step
+		WHERE saga_id = saga.id AND (status = 'success' OR status = 'pending' AND request_payload IS NOT NULL)
+	);`,
+}
+
+const createMigrationTable = `
+	CREATE TABLE IF NOT EXISTS saga_schema_migration (
+		version INTEGER PRIMARY KEY
+	)
+`
+
+const findMigrationVersion = `
+	SELECT COALESCE(MAX(version), 0)
+	FROM saga_schema_migration
+`
+
+const insertMigrationVersion = `
+	INSERT INTO saga_schema_migration (version)
+	VALUES ($1)
+`
+
+const findSaga = `
+	SELECT id, name, version, status, payload, payload_codec, payload_schema_version, revision
+	FROM saga
+	WHERE id = $1
+`
+
+const findSagaSteps = `
+	SELECT name, status, request_payload, response_payload, response_metadata, deadline, attempts, next_retry, last_error, group_name, required, request_metadata
+	FROM saga_step
+	WHERE saga_id = $1
+	ORDER BY position
+`
+
+const sagaExists = `
+	SELECT EXISTS (SELECT 1 FROM saga WHERE id = $1)
+`
+
+const insertSaga = `
+	INSERT INTO saga (id, name, version, status, payload, payload_codec, payload_schema_version, revision)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+const updateSaga = `
+	UPDATE saga
+	SET name = $1, version = $2, status = $3, payload = $4, payload_codec = $5, payload_schema_version = $6, revision = revision + 1
+	WHERE id = $7 AND revision = $8
+`
+
+const deleteSagaSteps = `
+	DELETE FROM saga_step
+	WHERE saga_id = $1
+`
+
+const insertSagaStep = `
+	INSERT INTO saga_step (saga_id, position, name, status, request_payload, response_payload, response_metadata, deadline, attempts, next_retry, last_error, group_name, required, request_metadata)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+`
+
+const findDeadLetters = `
+	SELECT s.id, s.name, st.name, st.attempts, st.last_error, st.next_retry
+	FROM saga s
+	JOIN saga_step st ON st.saga_id = s.id
+	WHERE s.status = $1 AND st.status = $2 AND st.attempts > 0
+	ORDER BY s.id, st.position
+	LIMIT $3
+`
+
+const findExpiredSteps = `
+	SELECT saga_id, name, deadline
+	FROM saga_step
+	WHERE status = $1 AND deadline IS NOT NULL AND deadline <= $2
+	ORDER BY deadline
+	LIMIT $3
+`
+
+const findDueRetries = `
+	SELECT saga_id, name, next_retry
+	FROM saga_step
+	WHERE next_retry IS NOT NULL AND next_retry <= $1
+	ORDER BY next_retry
+	LIMIT $2
+`
+
+const findActiveSagas = `
+	SELECT id
+	FROM saga
+	WHERE status NOT IN ($1, $2, $3) AND id > $4
+	ORDER BY id
+	LIMIT $5
+`
+
+const insertOutboxMessage = `
+	INSERT INTO saga_outbox (saga_id, step, compensation, type, payload, metadata, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+const findPendingOutboxMessages = `
+	SELECT id, step, compensation, payload, metadata, created_at, attempts, next_attempt, last_error
+	FROM saga_outbox
+	WHERE dispatched_at IS NULL AND (attempts = 0 OR next_attempt <= $1)
+	ORDER BY id
+	LIMIT $2
+`
+
+const markOutboxMessageDispatched = `
+	UPDATE saga_outbox
+	SET dispatched_at = $1
+	WHERE id = $2
+`
+
+const markOutboxMessageFailed = `
+	UPDATE saga_outbox
+	SET attempts = attempts + 1, next_attempt = $1, last_error = $2
+	WHERE id = $3
+`
+
+// SQLStore persists sagas with database/sql, with one row for the saga and
+// one row per step. The changes recorded on the saga are appended to the
+// saga_log table in the same transaction, so the rows are a snapshot of the
+// log that SQLLog can replay. The schema is written for SQLite.
+type SQLStore struct {
+	db        *sql.DB
+	ids       IDGenerator
+	processed *SQLProcessedMessages
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{
+		db:        db,
+		ids:       UUIDGenerator{},
+		processed: NewSQLProcessedMessages(db),
+	}
+}
+
+// WithIDGenerator sets the generator for sagas created without an id.
+func (r *SQLStore) WithIDGenerator(ids IDGenerator) *SQLStore {
+	r.ids = ids
+	return r
+}
+
+// WithRetention sets how long processed messages are remembered.
+func (r *SQLStore) WithRetention(retention time.Duration) *SQLStore {
+	r.processed.WithRetention(retention)
+	return r
+}
+
+// Migrate applies the migrations that have not been applied yet.
+func (r *SQLStore) Migrate(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, createMigrationTable); err != nil {
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRowContext(ctx, findMigrationVersion).Scan(&version); err != nil {
+			return err
+		}
+		for i := version; i < len(sqlMigrations); i++ {
+			if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+			if _, err := tx.ExecContext(ctx, insertMigrationVersion, i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SQLStore) FindSaga(ctx context.Context, id string) (Saga, error) {
+	var saga Saga
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		saga, err = findSagaTx(ctx, tx, id)
+		return err
+	})
+	return saga, err
+}
+
+// CreateSaga stores a new saga, generating an id if the saga has none.
+func (r *SQLStore) CreateSaga(ctx context.Context, saga *Saga) (Saga, error) {
+	cp := saga.clone()
+	if cp.ID == "" {
+		id, err := r.ids.NewID()
+		if err != nil {
+			return Saga{}, err
+		}
+		cp.ID = id
+	}
+	cp.Revision = 1
+
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, sagaExists, cp.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrAlreadyExists
+		}
+		if err := insertSagaTx(ctx, tx, &cp); err != nil {
+			return err
+		}
+		cp.changes = saga.changes
+		if err := appendSagaLogTx(ctx, tx, &cp, 0); err != nil {
+			return err
+		}
+		if saga.processed != "" {
+			if err := r.processed.claimTx(ctx, tx, saga.processed); err != nil {
+				return err
+			}
+		}
+		return insertOutboxMessagesTx(ctx, tx, saga.commands)
+	})
+	if err != nil {
+		return Saga{}, err
+	}
+	return cp.clone(), nil
+}
+
+// UpdateSaga saves the saga only if the stored revision matches the revision of
+// the given saga. It returns ErrNotFound if the saga does not exist.
+func (r *SQLStore) UpdateSaga(ctx context.Context, saga *Saga) (Saga, error) {
+	cp := saga.clone()
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		if err := updateSagaTx(ctx, tx, &cp); err != nil {
+			return err
+		}
+		cp.changes = saga.changes
+		if err := appendSagaLogTx(ctx, tx, &cp, saga.Revision); err != nil {
+			return err
+		}
+		if saga.processed != "" {
+			if err := r.processed.claimTx(ctx, tx, saga.processed); err != nil {
+				return err
+			}
+		}
+		return insertOutboxMessagesTx(ctx, tx, saga.commands)
+	})
+	if err != nil {
+		return Saga{}, err
+	}
+	return cp.clone(), nil
+}
+
+func (r *SQLStore) Processed(ctx context.Context, messageID string) (bool, error) {
+	return r.processed.Processed(ctx, messageID)
+}
+
+func (r *SQLStore) MarkProcessed(ctx context.Context, messageID string) error {
+	return r.processed.MarkProcessed(ctx, messageID)
+}
+
+func (r *SQLStore) Purge(ctx context.Context) (int, error) {
+	return r.processed.Purge(ctx)
+}
+
+func (r *SQLStore) PendingCommands(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error) {
+	rows, err := r.db.QueryContext(ctx, findPendingOutboxMessages, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.Command.Step,
+			&msg.Command.Compensation,
+			&msg.Command.Payload,
+			&msg.Command.Metadata,
+			&msg.CreatedAt,
+			&msg.Attempts,
+			&msg.NextAttempt,
+			&msg.LastError,
+		); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (r *SQLStore) MarkDispatched(ctx context.Context, id uint64) error {
+	res, err := r.db.ExecContext(ctx, markOutboxMessageDispatched, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *SQLStore) MarkFailed(ctx context.Context, id uint64, nextAttempt *time.Time, cause string) error {
+	res, err := r.db.ExecContext(ctx, markOutboxMessageFailed, utcTime(nextAttempt), cause, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *SQLStore) ExpiredSteps(ctx context.Context, now time.Time, limit int) ([]ExpiredStep, error) {
+	rows, err := r.db.QueryContext(ctx, findExpiredSteps, StepStatusPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []ExpiredStep
+	for rows.Next() {
+		var step ExpiredStep
+		if err := rows.Scan(&step.SagaID, &step.Step, &step.Deadline); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+func (r *SQLStore) DueRetries(ctx context.Context, now time.Time, limit int) ([]DueRetry, error) {
+	rows, err := r.db.QueryContext(ctx, findDueRetries, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retries []DueRetry
+	for rows.Next() {
+		var retry DueRetry
+		if err := rows.Scan(&retry.SagaID, &retry.Step, &retry.NextRetry); err != nil {
+			return nil, err
+		}
+		retries = append(retries, retry)
+	}
+	return retries, rows.Err()
+}
+
+func (r *SQLStore) ActiveSagas(ctx context.Context, after string, limit int) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, findActiveSagas, SagaStatusCompleted, SagaStatusCompensated, SagaStatusFailed, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *SQLStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := r.db.QueryContext(ctx, findDeadLetters, SagaStatusStuck, StepStatusSuccess, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var letter DeadLetter
+		if err := rows.Scan(
+			&letter.SagaID,
+			&letter.SagaName,
+			&letter.Step,
+			&letter.Attempts,
+			&letter.LastError,
+			&letter.NextRetry,
+		); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (r *SQLStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func findSagaTx(ctx context.Context, tx *sql.Tx, id string) (Saga, error) {
+	var saga Saga
+	err := tx.QueryRowContext(ctx, findSaga, id).Scan(
+		&saga.ID,
+		&saga.Name,
+		&saga.Version,
+		&saga.Status,
+		&saga.Payload,
+		&saga.PayloadCodec,
+		&saga.PayloadSchemaVersion,
+		&saga.Revision,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Saga{}, ErrNotFound
+	}
+	if err != nil {
+		return Saga{}, err
+	}
+
+	rows, err := tx.QueryContext(ctx, findSagaSteps, id)
+	if err != nil {
+		return Saga{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var step Step
+		if err := rows.Scan(
+			&step.Name,
+			&step.Status,
+			&step.RequestPayload,
+			&step.ResponsePayload,
+			&step.ResponseMetadata,
+			&step.Deadline,
+			&step.Attempts,
+			&step.NextRetry,
+			&step.LastError,
+			&step.Group,
+			&step.Required,
+			&step.RequestMetadata,
+		); err != nil {
+			return Saga{}, err
+		}
+		saga.Steps = append(saga.Steps, step)
+	}
+	return saga, rows.Err()
+}
+
+// updateSagaTx increments the revision of the saga in place.
+func updateSagaTx(ctx context.Context, tx *sql.Tx, saga *Saga) error {
+	res, err := tx.ExecContext(ctx, updateSaga,
+		saga.Name,
+		saga.Version,
+		saga.Status,
+		saga.Payload,
+		saga.PayloadCodec,
+		saga.PayloadSchemaVersion,
+		saga.ID,
+		saga.Revision,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, sagaExists, saga.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return ErrConcurrentModification
+	}
+	saga.Revision++
+
+	if _, err := tx.ExecContext(ctx, deleteSagaSteps, saga.ID); err != nil {
+		return err
+	}
+	return insertSagaStepsTx(ctx, tx, saga)
+}
+
+func insertSagaTx(ctx context.Context, tx *sql.Tx, saga *Saga) error {
+	if _, err := tx.ExecContext(ctx, insertSaga,
+		saga.ID,
+		saga.Name,
+		saga.Version,
+		saga.Status,
+		saga.Payload,
+		saga.PayloadCodec,
+		saga.PayloadSchemaVersion,
+		saga.Revision,
+	); err != nil {
+		return err
+	}
+	return insertSagaStepsTx(ctx, tx, saga)
+}
+
+func insertSagaStepsTx(ctx context.Context, tx *sql.Tx, saga *Saga) error {
+	for i, step := range saga.Steps {
+		if _, err := tx.ExecContext(ctx, insertSagaStep,
+			saga.ID,
+			i,
+			step.Name,
+			step.Status,
+			step.RequestPayload,
+			step.ResponsePayload,
+			step.ResponseMetadata,
+			utcTime(step.Deadline),
+			step.Attempts,
+			utcTime(step.NextRetry),
+			step.LastError,
+			step.Group,
+			step.Required,
+			step.RequestMetadata,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendSagaLogTx appends the changes recorded on the saga to its log. The log
+// of a saga stored before its changes were logged starts with its state.
+func appendSagaLogTx(ctx context.Context, tx *sql.Tx, saga *Saga, revision uint) error {
+	sequence, last, err := findLastLogRecordTx(ctx, tx, saga.ID)
+	if err != nil {
+		return err
+	}
+	if last != revision {
+		saga.changes = nil
+	}
+	records, err := logRecords(saga)
+	if err != nil {
+		return err
+	}
+	return insertLogRecordsTx(ctx, tx, saga.ID, sequence, records)
+}
+
+func insertOutboxMessagesTx(ctx context.Context, tx *sql.Tx, commands []CommandEnvelope) error {
+	now := time.Now()
+	for _, cmd := range commands {
+		if _, err := tx.ExecContext(ctx, insertOutboxMessage,
+			cmd.CorrelationID,
+			cmd.Step,
+			cmd.Compensation,
+			cmd.Type,
+			cmd.Payload,
+			cmd.Metadata,
+			now,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utcTime converts the time to UTC, so that stored times compare in order.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLStore(t *testing.T) *SQLStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "saga.db")+"?_foreign_keys=on")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	store := NewSQLStore(db)
+	require.Nil(t, store.Migrate(context.Background()))
+	return store
+}
+
+func TestSQLStore_Migrate(t *testing.T) {
+	store := newSQLStore(t)
+
+	// Migrations that have been applied are skipped.
+	assert.Nil(t, store.Migrate(context.Background()))
+}
+
+func TestSQLStore_MigrateDoneStatus(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := newSQLStore(t)
+
+	for _, saga := range []*Saga{
+		{
+			ID:     "1",
+			Status: SagaStatusCompleted,
+			Steps:  []Step{{Name: "create-booking", Status: StepStatusSuccess}},
+		},
+		{
+			ID:     "2",
+			Status: SagaStatusCompensated,
+			Steps:  []Step{{Name: "create-booking", Status: StepStatusCompensated}},
+		},
+		{
+			ID:     "3",
+			Status: SagaStatusCompensating,
+			Steps: []Step{
+				{Name: "create-booking", Status: StepStatusCompensated},
+				{Name: "create-payment", Status: StepStatusSuccess},
+			},
+		},
+	} {
+		_, err := store.CreateSaga(ctx, saga)
+		require.Nil(t, err)
+	}
+	_, err := store.db.Exec(`UPDATE saga SET status = 'done'`)
+	require.Nil(t, err)
+
+	// The 9th migration replaces the former done status, and the 16th leaves
+	// the sagas with a step left to undo compensating.
+	_, err = store.db.Exec(sqlMigrations[8])
+	require.Nil(t, err)
+	_, err = store.db.Exec(sqlMigrations[15])
+	require.Nil(t, err)
+
+	for id, want := range map[string]SagaStatus{
+		"1": SagaStatusCompleted,
+		"2": SagaStatusCompensated,
+		"3": SagaStatusCompensating,
+	} {
+		saga, err := store.FindSaga(ctx, id)
+		assert.Nil(err)
+		assert.Equal(want, saga.Status, "saga %s", id)
+		assert.Equal(saga.CheckStatus(), saga.Status, "saga %s", id)
+	}
+}
+
+func TestSQLStore_FindSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when not exists", func(t *testing.T) {
+		store := newSQLStore(t)
+
+		_, err := store.FindSaga(ctx, "1")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("when exists", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+
+		saga := NewBookingSagaDefinition().NewSaga("")
+		saga.Payload = []byte(`{"amount":100}`)
+		saga.Steps[0].Status = StepStatusSuccess
+		saga.Steps[0].ResponsePayload = []byte(`{"ID":"1"}`)
+
+		created, err := store.CreateSaga(ctx, saga)
+		assert.Nil(err)
+
+		found, err := store.FindSaga(ctx, created.ID)
+		assert.Nil(err)
+		if diff := cmp.Diff(created, found, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+			t.Errorf("saga diff (-want, +got):\n %s", diff)
+		}
+	})
+}
+
+func TestSQLStore_CreateSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when id is empty", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+
+		first, err := store.CreateSaga(ctx, &Saga{Name: "hello", Status: SagaStatusPending})
+		assert.Nil(err)
+
+		second, err := store.CreateSaga(ctx, &Saga{Name: "hello", Status: SagaStatusPending})
+		assert.Nil(err)
+
+		assert.NotEmpty(first.ID)
+		assert.NotEqual(first.ID, second.ID)
+	})
+
+	t.Run("when id is taken", func(t *testing.T) {
+		store := newSQLStore(t)
+
+		_, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.Nil(t, err)
+
+		_, err = store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.ErrorIs(t, err, ErrAlreadyExists)
+	})
+}
+
+func TestSQLStore_UpdateSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when revision matches", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.Nil(err)
+
+		created.Steps[1].Status = StepStatusSuccess
+		created.Steps[1].RequestPayload = []byte("{}")
+		updated, err := store.UpdateSaga(ctx, &created)
+		assert.Nil(err)
+		assert.Equal(created.Revision+1, updated.Revision)
+
+		found, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		if diff := cmp.Diff(updated, found, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+			t.Errorf("saga diff (-want, +got):\n %s", diff)
+		}
+	})
+
+	t.Run("when revision is stale", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+
+		created, err := store.CreateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.Nil(err)
+
+		_, err = store.UpdateSaga(ctx, &created)
+		assert.ErrorIs(err, ErrConcurrentModification)
+	})
+
+	t.Run("when not exists", func(t *testing.T) {
+		assert := assert.New(t)
+		store := newSQLStore(t)
+
+		_, err := store.UpdateSaga(ctx, NewBookingSagaDefinition().NewSaga("1"))
+		assert.ErrorIs(err, ErrNotFound)
+		_, err = store.FindSaga(ctx, "1")
+		assert.ErrorIs(err, ErrNotFound)
+	})
+}
+
+func TestSQLStore_BookingFlow(t *testing.T) {
+	assert := assert.New(t)
+	store := newSQLStore(t)
+	sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+	ctx := context.Background()
+
+	events := []event{
+		BookingCreated{ID: "1"},
+		PaymentCreated{ID: "1"},
+		BookingConfirmed{ID: "1"},
+	}
+	for _, evt := range events {
+		saga, err := sec.HandleEvent(ctx, evt)
+		assert.Nil(err)
+		assert.Nil(sec.ForwardFlow(ctx, *saga))
+	}
+
+	saga, err := store.FindSaga(ctx, "1")
+	assert.Nil(err)
+	assert.Equal(SagaStatusCompleted, saga.Status)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type StepStatus string
+
+const (
+	StepStatusPending     StepStatus = "pending"
+	StepStatusSuccess     StepStatus = "success"
+	StepStatusFailed      StepStatus = "failed"
+	StepStatusCompensated StepStatus = "compensated"
+
+	// StepStatusSkipped is a step whose condition did not hold, so its
+	// command was never sent.
+	StepStatusSkipped StepStatus = "skipped"
+)
+
+func (s StepStatus) Valid() bool {
+	switch s {
+	case
+		StepStatusPending,
+		StepStatusSuccess,
+		StepStatusFailed,
+		StepStatusCompensated,
+		StepStatusSkipped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s StepStatus) String() string {
+	return string(s)
+}
+
+func (s StepStatus) MarshalJSON() ([]byte, error) {
+	if !s.Valid() {
+		return nil, fmt.Errorf("invalid step status: %q", string(s))
+	}
+	return json.Marshal(string(s))
+}
+
+func (s *StepStatus) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	status := StepStatus(str)
+	if !status.Valid() {
+		return fmt.Errorf("invalid step status: %q", str)
+	}
+	*s = status
+	return nil
+}
+
+type SagaStatus string
+
+const (
+	SagaStatusPending      SagaStatus = "pending"
+	SagaStatusCompensating SagaStatus = "compensating"
+
+	// SagaStatusCompleted is a saga whose steps have all succeeded.
+	SagaStatusCompleted SagaStatus = "completed"
+
+	// SagaStatusCompensated is a saga whose successful steps have all been
+	// undone after a step failed.
+	SagaStatusCompensated SagaStatus = "compensated"
+
+	// SagaStatusFailed is a saga with a failed step, and no step to undo.
+	SagaStatusFailed SagaStatus = "failed"
+
+	// SagaStatusStuck is a compensating saga whose compensation keeps
+	// failing, and requires intervention.
+	SagaStatusStuck SagaStatus = "stuck"
+)
+
+// sagaTransitions are the statuses a saga can move to from each status.
+// Completed, compensated and failed sagas do not move again: a saga is no
+// longer compensated once its pivot has succeeded, e.g. a booking cannot be
+// rejected after it was confirmed.
+var sagaTransitions = map[SagaStatus][]SagaStatus{
+	SagaStatusPending: {
+		SagaStatusCompensating,
+		SagaStatusCompleted,
+		SagaStatusCompensated,
+		SagaStatusFailed,
+	},
+	SagaStatusCompensating: {
+		SagaStatusStuck,
+		SagaStatusCompensated,
+		SagaStatusFailed,
+	},
+	SagaStatusStuck: {
+		SagaStatusCompensating,
+		SagaStatusCompensated,
+		SagaStatusFailed,
+	},
+}
+
+func (s SagaStatus) Valid() bool {
+	switch s {
+	case
+		SagaStatusPending,
+		SagaStatusCompensating,
+		SagaStatusCompleted,
+		SagaStatusCompensated,
+		SagaStatusFailed,
+		SagaStatusStuck:
+		return true
+	default:
+		return false
+	}
+}
+
+// Terminal returns true if the saga has no more commands to send.
+func (s SagaStatus) Terminal() bool {
+	switch s {
+	case
+		SagaStatusCompleted,
+		SagaStatusCompensated,
+		SagaStatusFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// CanTransitionTo returns true if a saga in this status can move to the
+// given status.
+func (s SagaStatus) CanTransitionTo(to SagaStatus) bool {
+	for _, status := range sagaTransitions[s] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s SagaStatus) String() string {
+	return string(s)
+}
+
+func (s SagaStatus) MarshalJSON() ([]byte, error) {
+	if !s.Valid() {
+		return nil, fmt.Errorf("invalid saga status: %q", string(s))
+	}
+	return json.Marshal(string(s))
+}
+
+func (s *SagaStatus) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	status := SagaStatus(str)
+	// The former done status is derived from the steps when the saga is
+	// replayed.
+	if !status.Valid() && status != sagaStatusDone {
+		return fmt.Errorf("invalid saga status: %q", str)
+	}
+	*s = status
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepStatus(t *testing.T) {
+	t.Run("when marshalling", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b, err := json.Marshal(StepStatusSuccess)
+		assert.Nil(err)
+		assert.Equal(`"success"`, string(b))
+
+		_, err = json.Marshal(StepStatus("unknown"))
+		assert.NotNil(err)
+	})
+
+	t.Run("when unmarshalling", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var status StepStatus
+		assert.Nil(json.Unmarshal([]byte(`"compensated"`), &status))
+		assert.Equal(StepStatusCompensated, status)
+
+		assert.NotNil(json.Unmarshal([]byte(`"compensate"`), &status))
+	})
+}
+
+func TestSagaStatus(t *testing.T) {
+	t.Run("when marshalling", func(t *testing.T) {
+		assert := assert.New(t)
+
+		b, err := json.Marshal(SagaStatusCompensating)
+		assert.Nil(err)
+		assert.Equal(`"compensating"`, string(b))
+
+		_, err = json.Marshal(SagaStatus(""))
+		assert.NotNil(err)
+	})
+
+	t.Run("when unmarshalling", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var status SagaStatus
+		assert.Nil(json.Unmarshal([]byte(`"completed"`), &status))
+		assert.Equal(SagaStatusCompleted, status)
+
+		assert.NotNil(json.Unmarshal([]byte(`"finished"`), &status))
+	})
+}
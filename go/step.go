@@ -1,8 +1,74 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 type Step struct {
 	Name            string
 	RequestPayload  []byte
 	ResponsePayload []byte
-	Status          string
+	Status          StepStatus
+
+	// RequestMetadata describes the last command sent for the step.
+	RequestMetadata Metadata
+
+	// ResponseMetadata describes the last event applied to the step.
+	ResponseMetadata Metadata
+
+	// Deadline is when the step times out if it is still pending, or nil if
+	// the step has no timeout.
+	Deadline *time.Time
+
+	// Attempts is the number of times the current command of the step has
+	// failed to be sent, and NextRetry is when it is sent again.
+	Attempts  int
+	NextRetry *time.Time
+	// LastError is why the last attempt failed.
+	LastError string
+
+	// Group is the group of parallel steps the step belongs to, and
+	// Required is the number of steps of the group that must succeed, or
+	// zero if they all must.
+	Group    string
+	Required int
+}
+
+// sent returns true if the last command sent for the step is of the type of
+// the given command.
+func (s Step) sent(cmd command) bool {
+	return s.RequestMetadata.Type == typeName(cmd)
+}
+
+// awaiting returns true if the command of the step has been sent, and the
+// step is waiting for its event.
+func (s Step) awaiting() bool {
+	return s.Status == StepStatusPending && s.RequestPayload != nil
+}
+
+// DecodeResponse decodes the payload of the last event applied to the step
+// into v, with the codec it was encoded with.
+func (s Step) DecodeResponse(v interface{}) error {
+	if s.ResponsePayload == nil {
+		return fmt.Errorf("step %q has no response", s.Name)
+	}
+	return unmarshal(s.ResponseMetadata.Codec, s.ResponsePayload, v)
+}
+
+// clone returns a deep copy of the step.
+func (s Step) clone() Step {
+	s.RequestPayload = cloneBytes(s.RequestPayload)
+	s.ResponsePayload = cloneBytes(s.ResponsePayload)
+	s.RequestMetadata = s.RequestMetadata.clone()
+	s.ResponseMetadata = s.ResponseMetadata.clone()
+	if s.Deadline != nil {
+		deadline := *s.Deadline
+		s.Deadline = &deadline
+	}
+	if s.NextRetry != nil {
+		nextRetry := *s.NextRetry
+		s.NextRetry = &nextRetry
+	}
+	return s
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// StepTimedOut is fired by the TimeoutScheduler when a step is still pending
+// after its deadline. It fails the step.
+type StepTimedOut struct {
+	SagaID string
+	Step   string
+}
+
+func (StepTimedOut) isEvent() {}
+
+func (e StepTimedOut) sagaID() string {
+	return e.SagaID
+}
+
+// ExpiredStep is a pending step whose deadline has passed.
+type ExpiredStep struct {
+	SagaID   string
+	Step     string
+	Deadline time.Time
+}
+
+// Deadlines is implemented by repositories that can find the steps that have
+// timed out.
+type Deadlines interface {
+	// ExpiredSteps returns up to limit pending steps with a deadline at or
+	// before now, earliest first.
+	ExpiredSteps(ctx context.Context, now time.Time, limit int) ([]ExpiredStep, error)
+}
+
+// TimeoutScheduler fails the steps that are still pending after their
+// deadline, and compensates their sagas.
+type TimeoutScheduler struct {
+	coordinator *ExecutionCoordinator
+	deadlines   Deadlines
+	interval    time.Duration
+	batchSize   int
+	now         func() time.Time
+}
+
+// TimeoutScheduler returns a scheduler for the steps of the sagas in the
+// repository. It panics if the repository does not implement Deadlines.
+func (ec *ExecutionCoordinator) TimeoutScheduler() *TimeoutScheduler {
+	deadlines, ok := ec.repo.(Deadlines)
+	if !ok {
+		panic(fmt.Sprintf("repository %T does not implement Deadlines", ec.repo))
+	}
+	return &TimeoutScheduler{
+		coordinator: ec,
+		deadlines:   deadlines,
+		interval:    time.Second,
+		batchSize:   100,
+		now:         time.Now,
+	}
+}
+
+// WithInterval sets how often the deadlines are checked.
+func (s *TimeoutScheduler) WithInterval(interval time.Duration) *TimeoutScheduler {
+	s.interval = interval
+	return s
+}
+
+// Run fires the timeouts until the context is cancelled.
+func (s *TimeoutScheduler) Run(ctx context.Context) error {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			for {
+				n, err := s.Fire(ctx)
+				if err != nil || n < s.batchSize {
+					// The timeouts are retried on the next tick.
+					break
+				}
+			}
+		}
+	}
+}
+
+// Fire fails one batch of expired steps and starts the compensation of their
+// sagas, and returns the number of steps that timed out. Steps that fail are
+// logged and skipped, and are retried on the next call.
+func (s *TimeoutScheduler) Fire(ctx context.Context) (int, error) {
+	steps, err := s.deadlines.ExpiredSteps(ctx, s.now(), s.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, step := range steps {
+		if err := s.fire(ctx, step); err != nil {
+			log.Printf("failed to time out step %s of saga %s: %s\n", step.Step, step.SagaID, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *TimeoutScheduler) fire(ctx context.Context, step ExpiredStep) error {
+	saga, err := s.coordinator.HandleEvent(ctx, StepTimedOut{
+		SagaID: step.SagaID,
+		Step:   step.Step,
+	})
+	if err != nil {
+		return err
+	}
+	return s.coordinator.Continue(ctx, *saga)
+}
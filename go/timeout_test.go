@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTimeoutSagaDefinition(t *testing.T) *SagaDefinition {
+	def := NewBookingSagaDefinition()
+	step, err := def.GetStep("create-payment")
+	require.Nil(t, err)
+	step.WithTimeout(time.Minute)
+	return def
+}
+
+func TestTimeoutScheduler(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when the deadline passes", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, newTimeoutSagaDefinition(t))
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+			found, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			step, err := found.GetStep("create-payment")
+			require.Nil(t, err)
+			require.NotNil(t, step.Deadline)
+			deadline := *step.Deadline
+
+			scheduler := sec.TimeoutScheduler()
+			scheduler.now = func() time.Time { return deadline.Add(-time.Second) }
+
+			// Then nothing times out before the deadline.
+			n, err := scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+
+			scheduler.now = func() time.Time { return deadline.Add(time.Second) }
+			n, err = scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+
+			// Then the step fails, and the saga is compensated.
+			found, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			step, err = found.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Equal(StepStatusFailed, step.Status)
+			assert.Nil(step.Deadline)
+			assert.Equal(SagaStatusCompensating, found.CheckStatus())
+
+			commands := pub.Commands()
+			assert.Len(commands, 2)
+			assert.Equal("CancelBookingCommand", commands[1].Type)
+
+			// And the step does not time out again.
+			n, err = scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+		})
+
+		t.Run("when the event is received before the deadline", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), newTimeoutSagaDefinition(t))
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			require.Nil(t, sec.ForwardFlow(ctx, *saga))
+			saga, err = sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+			require.Nil(t, err)
+
+			step, err := saga.GetStep("create-payment")
+			assert.Nil(err)
+			assert.Nil(step.Deadline)
+
+			scheduler := sec.TimeoutScheduler()
+			scheduler.now = func() time.Time { return time.Now().Add(time.Hour) }
+			n, err := scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(0, n)
+		})
+		t.Run("when the command is sent again", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := &failingPublisher{
+				InMemoryPublisher: NewInMemoryPublisher(),
+				typ:               "CreatePaymentCommand",
+				failures:          1,
+				err:               errors.New("broker unavailable"),
+			}
+			def := newTimeoutSagaDefinition(t)
+			step, err := def.GetStep("create-payment")
+			require.Nil(t, err)
+			step.WithRetry(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second})
+			sec := NewExecutionCoordinator(store, pub, def)
+
+			saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+			require.Nil(t, err)
+			assert.NotNil(sec.ForwardFlow(ctx, *saga))
+			found, err := store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			sent, err := found.GetStep("create-payment")
+			require.Nil(t, err)
+			require.NotNil(t, sent.Deadline)
+			deadline := *sent.Deadline
+
+			retrier := sec.Retrier()
+			retrier.now = func() time.Time { return time.Now().Add(time.Hour) }
+			n, err := retrier.Retry(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+			found, err = store.FindSaga(ctx, "1")
+			require.Nil(t, err)
+			assert.Nil(sec.Resume(ctx, found))
+
+			// Then the deadline of the first attempt is kept.
+			assert.Len(pub.Commands(), 2)
+			found, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			resent, err := found.GetStep("create-payment")
+			assert.Nil(err)
+			require.NotNil(t, resent.Deadline)
+			assert.True(deadline.Equal(*resent.Deadline))
+
+			scheduler := sec.TimeoutScheduler()
+			scheduler.now = func() time.Time { return deadline.Add(time.Second) }
+			n, err = scheduler.Fire(ctx)
+			assert.Nil(err)
+			assert.Equal(1, n)
+		})
+	})
+
+	t.Run("when the timeout is received late", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), newTimeoutSagaDefinition(t))
+
+		saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+		require.Nil(t, err)
+		require.Nil(t, sec.ForwardFlow(ctx, *saga))
+		saga, err = sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+		require.Nil(t, err)
+
+		// Then the step is not modified.
+		timedOut, err := sec.Router().Route(ctx, StepTimedOut{SagaID: "1", Step: "create-payment"})
+		assert.Nil(err)
+		assert.Equal(saga.Revision, timedOut.Revision)
+	})
+
+	t.Run("when the repository has no deadlines", func(t *testing.T) {
+		sec := NewExecutionCoordinator(NewLogStore(NewInMemoryLog()), NewInMemoryPublisher(), NewBookingSagaDefinition())
+		assert.Panics(t, func() { sec.TimeoutScheduler() })
+	})
+}
+
+func TestLogStore_Deadline(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := NewLogStore(NewSQLLog(newSQLStore(t).db))
+	sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), newTimeoutSagaDefinition(t))
+
+	saga, err := sec.HandleEvent(ctx, BookingCreated{ID: "1"})
+	require.Nil(t, err)
+	require.Nil(t, sec.ForwardFlow(ctx, *saga))
+
+	// Then the deadline is replayed from the log.
+	found, err := store.FindSaga(ctx, "1")
+	assert.Nil(err)
+	step, err := found.GetStep("create-payment")
+	assert.Nil(err)
+	assert.NotNil(step.Deadline)
+}
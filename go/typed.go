@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedSaga is a saga with its input decoded into T. The saga is still
+// persisted with its payloads as bytes.
+type TypedSaga[T any] struct {
+	Saga
+	Input T
+}
+
+// NewTypedSaga decodes the input of the saga, with the codec it was encoded
+// with.
+func NewTypedSaga[T any](saga Saga) (TypedSaga[T], error) {
+	typed := TypedSaga[T]{Saga: saga}
+	if err := saga.DecodePayload(&typed.Input); err != nil {
+		return TypedSaga[T]{}, fmt.Errorf("decode payload of saga %q: %w", saga.ID, err)
+	}
+	return typed, nil
+}
+
+// Response decodes the response of the step with the given name into R.
+func Response[R, T any](saga TypedSaga[T], name string) (R, error) {
+	var res R
+	if err := saga.DecodeResponse(name, &res); err != nil {
+		return res, fmt.Errorf("decode response of step %q: %w", name, err)
+	}
+	return res, nil
+}
+
+// Map returns a mapper that builds the command of a step from the saga with
+// its input decoded into T.
+func Map[T any, C command](fn func(saga TypedSaga[T]) (C, error)) CommandMapper {
+	return func(saga Saga) (command, error) {
+		typed, err := NewTypedSaga[T](saga)
+		if err != nil {
+			return nil, err
+		}
+		return fn(typed)
+	}
+}
+
+// StepHandler executes the command of a step for a participant, and returns
+// the event that reports the outcome.
+type StepHandler[Req command, Res event] func(ctx context.Context, req Req) (Res, error)
+
+// Handle decodes the command with the codec it was encoded with, and executes
+// it. It returns an error if the command is not of type Req.
+func (h StepHandler[Req, Res]) Handle(ctx context.Context, cmd CommandEnvelope) (res Res, err error) {
+	var req Req
+	if cmd.Type != typeName(req) {
+		return res, fmt.Errorf("step handler of %s cannot handle command %s", typeName(req), cmd.Type)
+	}
+	if err := unmarshal(cmd.Codec, cmd.Payload, &req); err != nil {
+		return res, fmt.Errorf("decode command %s: %w", cmd.Type, err)
+	}
+	return h(ctx, req)
+}
+
+// Reply handles the command, and wraps its event in an envelope caused by the
+// command, to be delivered to HandleMessage.
+func (h StepHandler[Req, Res]) Reply(ctx context.Context, cmd CommandEnvelope) (Envelope, error) {
+	res, err := h.Handle(ctx, cmd)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return NewReplyEnvelope(cmd, res)
+}
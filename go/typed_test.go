@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedSaga(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("when the saga is decoded", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1", Amount: 250}, PaymentCreated{ID: "1"})
+
+		saga, err := store.FindSaga(ctx, "1")
+		require.Nil(t, err)
+		typed, err := NewTypedSaga[BookingCreated](saga)
+		assert.Nil(err)
+		assert.Equal(BookingCreated{ID: "1", Amount: 250}, typed.Input)
+		assert.Equal(saga.Revision, typed.Revision)
+
+		// Then the responses of the steps are decoded too.
+		payment, err := Response[PaymentCreated](typed, "create-payment")
+		assert.Nil(err)
+		assert.Equal(PaymentCreated{ID: "1"}, payment)
+
+		_, err = Response[BookingConfirmed](typed, "confirm-booking")
+		assert.NotNil(err)
+	})
+
+	t.Run("when the saga has no payload", func(t *testing.T) {
+		_, err := NewTypedSaga[BookingCreated](Saga{ID: "1"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("when the payload is of another type", func(t *testing.T) {
+		_, err := NewTypedSaga[BookingCreated](Saga{ID: "1", Payload: []byte(`{"ID":1}`)})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestStepHandler(t *testing.T) {
+	ctx := context.Background()
+	handler := StepHandler[CreatePaymentCommand, PaymentCreated](func(ctx context.Context, cmd CreatePaymentCommand) (PaymentCreated, error) {
+		return PaymentCreated{ID: cmd.BookingID}, nil
+	})
+
+	t.Run("when the command is handled", func(t *testing.T) {
+		assert := assert.New(t)
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(NewInMemoryStore(), pub, NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1", Amount: 250})
+
+		// Then the handler receives the typed command, and its event
+		// continues the saga.
+		evt, err := handler.Handle(ctx, pub.Commands()[0])
+		assert.Nil(err)
+		assert.Equal(PaymentCreated{ID: "1"}, evt)
+		handle(t, sec, evt)
+		assert.Equal("ConfirmBookingCommand", pub.Commands()[1].Type)
+	})
+
+	t.Run("when the reply is handled", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		pub := NewInMemoryPublisher()
+		sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition()).WithProcessedMessages(store)
+		handle(t, sec, BookingCreated{ID: "1", Amount: 250})
+
+		// Then the event is wrapped in an envelope caused by the command.
+		cmd := pub.Commands()[0]
+		env, err := handler.Reply(ctx, cmd)
+		assert.Nil(err)
+		assert.Equal("PaymentCreated", env.Type)
+		assert.Equal("1", env.CorrelationID)
+		assert.Equal(cmd.MessageID, env.CausationID)
+		assert.Equal(cmd.Codec, env.Codec)
+
+		saga, err := sec.HandleMessage(ctx, env)
+		assert.Nil(err)
+		assert.Nil(sec.Continue(ctx, *saga))
+		assert.Len(pub.Commands(), 2)
+
+		// And the reply delivered again is a duplicate.
+		_, err = sec.HandleMessage(ctx, env)
+		assert.ErrorIs(err, ErrDuplicateMessage)
+	})
+
+	t.Run("when the command is of another type", func(t *testing.T) {
+		env, err := newEnvelope(JSONCodec{}, SchemaVersion, "1", "", ConfirmBookingCommand{BookingID: "1"})
+		require.Nil(t, err)
+
+		_, err = handler.Handle(ctx, CommandEnvelope{Envelope: env, Step: "confirm-booking"})
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBookingSagaDefinitionV2 notifies the customer once the booking is
+// confirmed, and migrates the sagas of the first version if migrate is true.
+func newBookingSagaDefinitionV2(migrate bool) *SagaDefinition {
+	def := newNotifySagaDefinition().WithVersion(2)
+	if migrate {
+		def.WithMigration(func(saga *Saga) error {
+			return saga.InsertStep("confirm-booking", Step{
+				Name:   "notify-customer",
+				Status: StepStatusPending,
+			})
+		})
+	}
+	return def
+}
+
+func TestDefinitionVersion(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, newStore func(t *testing.T) testStore) {
+		t.Run("when sagas are in flight on the previous version", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			handle(t, sec, BookingCreated{ID: "1"})
+
+			sec = NewExecutionCoordinator(store, pub, NewBookingSagaDefinition(), newBookingSagaDefinitionV2(false))
+			handle(t, sec, BookingCreated{ID: "2"})
+
+			// Then the saga in flight continues on its version.
+			handle(t, sec, PaymentCreated{ID: "1"}, BookingConfirmed{ID: "1"})
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(uint(1), saga.Version)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+
+			// And new sagas start on the latest version.
+			handle(t, sec, PaymentCreated{ID: "2"}, BookingConfirmed{ID: "2"})
+			saga, err = store.FindSaga(ctx, "2")
+			assert.Nil(err)
+			assert.Equal(uint(2), saga.Version)
+			assert.Equal(SagaStatusPending, saga.Status)
+			assert.Equal("NotifyCustomerCommand notify-customer", steps(pub)[len(pub.Commands())-1])
+		})
+
+		t.Run("when the previous version is migrated", func(t *testing.T) {
+			assert := assert.New(t)
+			store := newStore(t)
+			pub := NewInMemoryPublisher()
+			sec := NewExecutionCoordinator(store, pub, NewBookingSagaDefinition())
+			handle(t, sec, BookingCreated{ID: "1"})
+
+			sec = NewExecutionCoordinator(store, pub, newBookingSagaDefinitionV2(true))
+			handle(t, sec, PaymentCreated{ID: "1"})
+
+			// Then the saga is upgraded when it is loaded.
+			saga, err := store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(uint(2), saga.Version)
+			assert.Len(saga.Steps, 4)
+
+			// And it continues with the steps of the new version.
+			handle(t, sec, BookingConfirmed{ID: "1"}, CustomerNotified{ID: "1"})
+			assert.Equal([]string{
+				"CreatePaymentCommand create-payment",
+				"ConfirmBookingCommand confirm-booking",
+				"NotifyCustomerCommand notify-customer",
+			}, steps(pub))
+			saga, err = store.FindSaga(ctx, "1")
+			assert.Nil(err)
+			assert.Equal(SagaStatusCompleted, saga.Status)
+		})
+	})
+
+	t.Run("when the migrated saga is replayed from the log", func(t *testing.T) {
+		assert := assert.New(t)
+		log := NewInMemoryLog()
+		store := NewLogStore(log)
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1"})
+
+		sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), newBookingSagaDefinitionV2(true))
+		handle(t, sec, PaymentCreated{ID: "1"})
+
+		// Then the log replays to the migrated saga.
+		saga, err := store.FindSaga(ctx, "1")
+		assert.Nil(err)
+		assert.Equal(uint(2), saga.Version)
+		records, err := log.Read(ctx, "1", 0)
+		require.Nil(t, err)
+		replayed, err := ReplaySaga(Saga{}, records)
+		assert.Nil(err)
+		if diff := cmp.Diff(saga, replayed, cmpopts.IgnoreUnexported(Saga{})); diff != "" {
+			t.Errorf("saga diff (-stored, +replayed):\n %s", diff)
+		}
+	})
+
+	t.Run("when the version of the saga is not registered", func(t *testing.T) {
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1"})
+
+		sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), newBookingSagaDefinitionV2(false))
+		_, err := sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("when the migration does not match the new version", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewInMemoryStore()
+		sec := NewExecutionCoordinator(store, NewInMemoryPublisher(), NewBookingSagaDefinition())
+		handle(t, sec, BookingCreated{ID: "1"})
+
+		def := newBookingSagaDefinitionV2(false).WithMigration(func(saga *Saga) error {
+			return saga.InsertStep("", Step{Name: "notify-customer", Status: StepStatusPending})
+		})
+		sec = NewExecutionCoordinator(store, NewInMemoryPublisher(), def)
+		_, err := sec.HandleEvent(ctx, PaymentCreated{ID: "1"})
+		assert.NotNil(err)
+
+		// Then the saga is left on its version.
+		saga, err := store.FindSaga(ctx, "1")
+		require.Nil(t, err)
+		assert.Equal(uint(1), saga.Version)
+	})
+
+	t.Run("when the version is registered twice", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewExecutionCoordinator(NewInMemoryStore(), NewInMemoryPublisher(), NewBookingSagaDefinition(), NewBookingSagaDefinition())
+		})
+	})
+
+	t.Run("when the first version has a migration", func(t *testing.T) {
+		def := NewBookingSagaDefinition().WithMigration(func(saga *Saga) error {
+			return nil
+		})
+
+		assert.NotNil(t, def.Validate())
+		assert.NotNil(t, NewBookingSagaDefinition().WithVersion(0).Validate())
+	})
+}